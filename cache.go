@@ -14,6 +14,23 @@ type HTTPCache struct {
 	cacheKeyTemplate string
 	entries          [cacheBucketsSize]map[string][]*HTTPCacheEntry
 	entriesLock      [cacheBucketsSize]*sync.RWMutex
+
+	// limits bounds the size of the cache, nil means unbounded
+	limits *cacheLimits
+	// path is where the records of the entries are saved, empty means they are not saved
+	path string
+}
+
+// cacheLimits tracks the entries of the cache to evict them when it is full
+// Its mutex can be acquired while holding the lock of a bucket, never the other way around
+type cacheLimits struct {
+	maxSize    int64
+	maxEntries int
+	policy     EvictionPolicy
+
+	mutex sync.Mutex
+	size  int64
+	sizes map[*HTTPCacheEntry]int64
 }
 
 func NewHTTPCache(cacheKeyTemplate string) *HTTPCache {
@@ -46,6 +63,7 @@ func (cache *HTTPCache) Get(request *http.Request) (*HTTPCacheEntry, bool) {
 
 	for _, entry := range previousEntries {
 		if entry.Fresh() && matchesVary(request, entry) {
+			cache.touch(entry)
 			return entry, true
 		}
 	}
@@ -53,34 +71,98 @@ func (cache *HTTPCache) Get(request *http.Request) (*HTTPCacheEntry, bool) {
 	return nil, false
 }
 
+// GetStale returns an expired entry that is still in its grace window
+func (cache *HTTPCache) GetStale(request *http.Request) (*HTTPCacheEntry, bool) {
+	key := getKey(cache.cacheKeyTemplate, request)
+	b := cache.getBucketIndexForKey(key)
+	cache.entriesLock[b].RLock()
+	defer cache.entriesLock[b].RUnlock()
+
+	for _, entry := range cache.entries[b][key] {
+		if entry.Stale() && matchesVary(request, entry) {
+			return entry, true
+		}
+	}
+
+	return nil, false
+}
+
+// Put stores the entry, unless it is bigger than the maximum size of the cache
+// The handler serves those entries without storing them, see fits
 func (cache *HTTPCache) Put(request *http.Request, entry *HTTPCacheEntry) {
+	if !cache.fits(entry) {
+		return
+	}
+	cache.put(entry, true)
+	cache.persist(entry)
+	cache.evict()
+}
+
+// put stores the entry, replace tells what to do if there is already one for its key and Vary
+// It returns false if the entry was not stored
+func (cache *HTTPCache) put(entry *HTTPCacheEntry, replace bool) bool {
 	key := entry.Key()
 	bucket := cache.getBucketIndexForKey(key)
 
 	cache.entriesLock[bucket].Lock()
 	defer cache.entriesLock[bucket].Unlock()
 
-	cache.scheduleCleanEntry(entry)
-
+	previous := -1
 	for i, previousEntry := range cache.entries[bucket][key] {
 		if matchesVary(entry.Request, previousEntry) {
-			go previousEntry.Clean()
-			cache.entries[bucket][key][i] = entry
-			return
+			previous = i
+			break
 		}
 	}
+	if previous >= 0 && !replace {
+		return false
+	}
+
+	cache.scheduleCleanEntry(entry)
+	cache.track(entry)
+
+	if previous >= 0 {
+		previousEntry := cache.entries[bucket][key][previous]
+		cache.untrack(previousEntry)
+		go previousEntry.Clean()
+		cache.entries[bucket][key][previous] = entry
+		return true
+	}
 
 	cache.entries[bucket][key] = append(cache.entries[bucket][key], entry)
+	return true
+}
+
+// Delete removes every entry stored for the key
+func (cache *HTTPCache) Delete(key string) {
+	bucket := cache.getBucketIndexForKey(key)
+
+	cache.entriesLock[bucket].Lock()
+	defer cache.entriesLock[bucket].Unlock()
+
+	for _, entry := range cache.entries[bucket][key] {
+		cache.untrack(entry)
+		go entry.Clean()
+	}
+	delete(cache.entries[bucket], key)
 }
 
 func (cache *HTTPCache) scheduleCleanEntry(entry *HTTPCacheEntry) {
 	go func(entry *HTTPCacheEntry) {
-		time.Sleep(entry.expiration.Sub(time.Now().UTC()))
+		// Expired entries are kept while they can be served stale
+		time.Sleep(entry.graceEnd().Sub(time.Now().UTC()))
 		cache.cleanEntry(entry)
 	}(entry)
 }
 
 func (cache *HTTPCache) cleanEntry(entry *HTTPCacheEntry) {
+	if cache.removeEntry(entry) {
+		entry.Clean()
+	}
+}
+
+// removeEntry takes the entry out of the cache, it returns false if it was already removed
+func (cache *HTTPCache) removeEntry(entry *HTTPCacheEntry) bool {
 	key := entry.Key()
 	bucket := cache.getBucketIndexForKey(key)
 
@@ -90,9 +172,150 @@ func (cache *HTTPCache) cleanEntry(entry *HTTPCacheEntry) {
 	for i, otherEntry := range cache.entries[bucket][key] {
 		if entry == otherEntry {
 			cache.entries[bucket][key] = append(cache.entries[bucket][key][:i], cache.entries[bucket][key][i+1:]...)
-			entry.Clean()
+			if len(cache.entries[bucket][key]) == 0 {
+				delete(cache.entries[bucket], key)
+			}
+			cache.untrack(entry)
+			return true
+		}
+	}
+	return false
+}
+
+// SetLimits bounds the cache to maxSize bytes and maxEntries entries, 0 means no limit
+// The policy chooses the entries evicted when any limit is exceeded
+func (cache *HTTPCache) SetLimits(maxSize int64, maxEntries int, policy EvictionPolicy) {
+	cache.limits = &cacheLimits{
+		maxSize:    maxSize,
+		maxEntries: maxEntries,
+		policy:     policy,
+		sizes:      make(map[*HTTPCacheEntry]int64),
+	}
+}
+
+// fits returns false if the entry is bigger than the maximum size of the cache
+// Storing it would evict every other entry and then itself
+func (cache *HTTPCache) fits(entry *HTTPCacheEntry) bool {
+	limits := cache.limits
+	if limits == nil || limits.maxSize == 0 {
+		return true
+	}
+	size, known := entry.size()
+	return !known || size <= limits.maxSize
+}
+
+func (cache *HTTPCache) track(entry *HTTPCacheEntry) {
+	limits := cache.limits
+	if limits == nil {
+		return
+	}
+	size, known := entry.size()
+
+	limits.mutex.Lock()
+	limits.sizes[entry] = size
+	limits.size += size
+	limits.policy.Add(entry, size)
+	limits.mutex.Unlock()
+
+	// The size of the body is only known once it is completely stored
+	if !known && entry.isPublic {
+		go func() {
+			entry.Response.WaitClose()
+			cache.resize(entry)
+			// Only the entry itself is removed when it turns out to be bigger than the cache
+			if !cache.fits(entry) {
+				if cache.removeEntry(entry) {
+					go entry.Clean()
+				}
+				return
+			}
+			cache.evict()
+		}()
+	}
+}
+
+func (cache *HTTPCache) resize(entry *HTTPCacheEntry) {
+	limits := cache.limits
+	size, _ := entry.size()
+
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+	previous, ok := limits.sizes[entry]
+	if !ok {
+		return
+	}
+	limits.sizes[entry] = size
+	limits.size += size - previous
+	limits.policy.Add(entry, size)
+}
+
+func (cache *HTTPCache) untrack(entry *HTTPCacheEntry) {
+	limits := cache.limits
+	if limits == nil {
+		return
+	}
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+	limits.untrack(entry)
+}
+
+func (limits *cacheLimits) untrack(entry *HTTPCacheEntry) {
+	size, ok := limits.sizes[entry]
+	if !ok {
+		return
+	}
+	delete(limits.sizes, entry)
+	limits.size -= size
+	limits.policy.Remove(entry)
+}
+
+func (cache *HTTPCache) touch(entry *HTTPCacheEntry) {
+	limits := cache.limits
+	if limits == nil {
+		return
+	}
+	limits.mutex.Lock()
+	limits.policy.Touch(entry)
+	limits.mutex.Unlock()
+}
+
+// victim chooses the next entry to evict and stops tracking it, nil means the cache is not full
+func (limits *cacheLimits) victim() *HTTPCacheEntry {
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+
+	full := (limits.maxSize > 0 && limits.size > limits.maxSize) ||
+		(limits.maxEntries > 0 && len(limits.sizes) > limits.maxEntries)
+	if !full {
+		return nil
+	}
+	entry := limits.policy.Victim()
+	if entry != nil {
+		limits.untrack(entry)
+	}
+	return entry
+}
+
+// evict removes entries until the cache is within its limits
+// The files are removed once the readers still subscribed to them finish
+func (cache *HTTPCache) evict() {
+	if cache.limits == nil {
+		return
+	}
+	for {
+		entry := cache.limits.victim()
+		if entry == nil {
 			return
 		}
+		// The entry may have been removed since it was chosen, whoever removed it cleans it
+		if !cache.removeEntry(entry) {
+			continue
+		}
+		go entry.Clean()
+		// The metrics are defined on startup, after the restored entries are evicted
+		if evictions != nil {
+			evictions.WithLabelValues(cache.limits.policy.Name()).Inc()
+		}
 	}
 }
 
@@ -3,6 +3,9 @@ package gcsproxy
 import (
 	"io"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Menta2L/caddy-gcsproxy/storage"
@@ -14,6 +17,15 @@ type HTTPCacheEntry struct {
 	expiration time.Time
 	key        string
 
+	// staleWhileRevalidate and staleIfError are the grace windows after the expiration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	// record is the file with the metadata of the entry, see persist.go
+	record     string
+	cleaned    bool
+	recordLock sync.Mutex
+
 	Request  *http.Request
 	Response *Response
 }
@@ -22,13 +34,16 @@ type HTTPCacheEntry struct {
 // and it also calculates if the response is public
 func NewHTTPCacheEntry(key string, request *http.Request, response *Response, config *Config) *HTTPCacheEntry {
 	isPublic, expiration := getCacheableStatus(request, response, config)
+	staleWhileRevalidate, staleIfError := staleWindows(response, config)
 
 	return &HTTPCacheEntry{
-		key:        key,
-		isPublic:   isPublic,
-		expiration: expiration,
-		Request:    request,
-		Response:   response,
+		key:                  key,
+		isPublic:             isPublic,
+		expiration:           expiration,
+		staleWhileRevalidate: staleWhileRevalidate,
+		staleIfError:         staleIfError,
+		Request:              request,
+		Response:             response,
 	}
 }
 
@@ -37,7 +52,9 @@ func (e *HTTPCacheEntry) Key() string {
 }
 
 // Clean removes the response if it has an associated file
+// The record is removed first, a body without record is never restored
 func (e *HTTPCacheEntry) Clean() error {
+	e.removeRecord()
 	return e.Response.Clean()
 }
 
@@ -57,6 +74,17 @@ func (e *HTTPCacheEntry) writePrivateResponse(w http.ResponseWriter) error {
 	return nil
 }
 
+// WriteRangeTo writes length bytes of the body starting at offset.
+// It can be used even if the body is still being written.
+func (e *HTTPCacheEntry) WriteRangeTo(w io.Writer, offset, length int64) error {
+	reader, err := e.Response.body.GetReader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return copyRange(w, reader, offset, length)
+}
+
 // WriteBodyTo sends the body to the http.ResponseWritter
 func (e *HTTPCacheEntry) WriteBodyTo(w http.ResponseWriter) error {
 	if !e.isPublic {
@@ -65,8 +93,14 @@ func (e *HTTPCacheEntry) WriteBodyTo(w http.ResponseWriter) error {
 	return e.writePublicResponse(w)
 }
 
+// setStorage stores the body in memory if it is small enough, otherwise in a file
 func (e *HTTPCacheEntry) setStorage(config *Config) error {
-	storage, err := storage.NewFileStorage(config.Path)
+	if body := config.memory.storage(e); body != nil {
+		e.Response.SetBody(body)
+		return nil
+	}
+
+	storage, err := storage.NewFileStorage(config.storagePath())
 
 	// Set the storage even if it is nil to continue and stop the upstream request
 	e.Response.SetBody(storage)
@@ -75,6 +109,28 @@ func (e *HTTPCacheEntry) setStorage(config *Config) error {
 }
 
 // Fresh returns if the entry is still fresh
+// Entries whose body could not be fully fetched are never fresh
 func (e *HTTPCacheEntry) Fresh() bool {
-	return e.expiration.After(time.Now())
+	return e.expiration.After(time.Now()) && !e.Response.Failed()
+}
+
+// hitStatus is the cache status of an entry served from the cache
+// Missing objects have their own status to tell them apart from the found ones
+func hitStatus(entry *HTTPCacheEntry) string {
+	if entry.Response.Code == http.StatusNotFound {
+		return cacheNegative
+	}
+	return cacheHit
+}
+
+// size returns the bytes stored for the entry and if they are final
+// The size is known from the Content-Length or when the whole body is written
+func (e *HTTPCacheEntry) size() (int64, bool) {
+	if !e.isPublic {
+		return 0, true
+	}
+	if length, err := strconv.ParseInt(e.Response.snapHeader.Get("Content-Length"), 10, 64); err == nil && length >= 0 {
+		return length, true
+	}
+	return atomic.LoadInt64(&e.Response.written), false
 }
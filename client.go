@@ -0,0 +1,176 @@
+package gcsproxy
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var (
+	defaultConnectTimeout      = time.Duration(10) * time.Second
+	defaultHeaderTimeout       = time.Duration(30) * time.Second
+	defaultIdleTimeout         = time.Duration(90) * time.Second
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 16
+	defaultRetries             = 2
+	defaultRetryBaseDelay      = time.Duration(100) * time.Millisecond
+	defaultRetryMaxDelay       = time.Duration(2) * time.Second
+)
+
+// ClientConfig specifies the http client used to reach GCS
+type ClientConfig struct {
+	ConnectTimeout      time.Duration
+	HeaderTimeout       time.Duration
+	IdleTimeout         time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// Retries is the number of extra attempts after a retryable failure
+	Retries        int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+}
+
+func defaultClientConfig() *ClientConfig {
+	return &ClientConfig{
+		ConnectTimeout:      defaultConnectTimeout,
+		HeaderTimeout:       defaultHeaderTimeout,
+		IdleTimeout:         defaultIdleTimeout,
+		MaxIdleConns:        defaultMaxIdleConns,
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		Retries:             defaultRetries,
+		RetryBaseDelay:      defaultRetryBaseDelay,
+		RetryMaxDelay:       defaultRetryMaxDelay,
+	}
+}
+
+// UpstreamClient sends the requests to GCS retrying the failed ones
+type UpstreamClient struct {
+	config *ClientConfig
+	client *http.Client
+}
+
+// NewUpstreamClient creates a client with its own connection pool
+func NewUpstreamClient(config *ClientConfig) *UpstreamClient {
+	dialer := &net.Dialer{
+		Timeout:   config.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   config.ConnectTimeout,
+		ResponseHeaderTimeout: config.HeaderTimeout,
+		IdleConnTimeout:       config.IdleTimeout,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &UpstreamClient{
+		config: config,
+		client: &http.Client{Transport: transport},
+	}
+}
+
+// Do sends the request retrying it with a jittered exponential backoff
+// on 429, 5xx and connection errors. The request must not have a body.
+// ctx only stops the retries, the request itself is not bound to it
+// so a body shared with other clients is not aborted
+func (c *UpstreamClient) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := c.client.Do(req)
+		if attempt >= c.config.Retries || !shouldRetry(res, err) {
+			return res, err
+		}
+
+		delay := c.backoff(attempt)
+		if res != nil {
+			if retryAfter, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+				// Waiting longer than allowed is pointless, return the GCS answer
+				if retryAfter > c.config.RetryMaxDelay {
+					return res, err
+				}
+				if retryAfter > delay {
+					delay = retryAfter
+				}
+			}
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// DoOnce sends the request without retries, it is used for requests with a body
+func (c *UpstreamClient) DoOnce(req *http.Request) (*http.Response, error) {
+	return c.client.Do(req)
+}
+
+// backoff returns a random delay up to base * 2^attempt limited by the max delay
+func (c *UpstreamClient) backoff(attempt int) time.Duration {
+	delay := c.config.RetryMaxDelay
+	if attempt < 32 {
+		if d := c.config.RetryBaseDelay << uint(attempt); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay))) + 1
+}
+
+func shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return isConnectionReset(err)
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+// isConnectionReset unwraps the errors of the transport down to the system call error
+// errors.Is needs Go 1.13
+func isConnectionReset(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNRESET || err == syscall.EPIPE
+}
+
+// parseRetryAfter parses the Retry-After header in seconds or HTTP date format
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	delay := t.Sub(time.Now())
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
@@ -0,0 +1,32 @@
+package gcsproxy
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsConnectionReset(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://gcs", Err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", err)}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"reset", wrap(syscall.ECONNRESET), true},
+		{"broken pipe", wrap(syscall.EPIPE), true},
+		{"bare errno", syscall.ECONNRESET, true},
+		{"refused", wrap(syscall.ECONNREFUSED), false},
+		{"other", errors.New("reset"), false},
+	}
+	for _, test := range tests {
+		if got := isConnectionReset(test.err); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
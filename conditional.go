@@ -0,0 +1,200 @@
+package gcsproxy
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// condResult is the result of an HTTP request precondition check.
+// See https://tools.ietf.org/html/rfc7232 section 3.
+type condResult int
+
+const (
+	condNone condResult = iota
+	condTrue
+	condFalse
+)
+
+// scanETag determines if a syntactically valid ETag is present at s. If so,
+// the ETag and remaining text after consuming ETag is returned. Otherwise,
+// it returns "", "".
+func scanETag(s string) (etag string, remain string) {
+	s = textproto.TrimString(s)
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return "", ""
+	}
+	// ETag is either W/"text" or "text".
+	for i := start + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		// Character values allowed in ETags.
+		case c == 0x21 || c >= 0x23 && c <= 0x7E || c >= 0x80:
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		default:
+			return "", ""
+		}
+	}
+	return "", ""
+}
+
+// etagStrongMatch reports whether a and b match using strong ETag comparison.
+func etagStrongMatch(a, b string) bool {
+	return a == b && a != "" && a[0] == '"'
+}
+
+// etagWeakMatch reports whether a and b match using weak ETag comparison.
+func etagWeakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// matchETagList walks a comma separated list of ETags calling match for each one.
+// It returns condTrue if any ETag matches or the list is "*"
+func matchETagList(list string, etag string, match func(a, b string) bool) condResult {
+	for {
+		list = textproto.TrimString(list)
+		if len(list) == 0 {
+			break
+		}
+		if list[0] == ',' {
+			list = list[1:]
+			continue
+		}
+		if list[0] == '*' {
+			return condTrue
+		}
+		candidate, remain := scanETag(list)
+		if candidate == "" {
+			break
+		}
+		if match(candidate, etag) {
+			return condTrue
+		}
+		list = remain
+	}
+	return condFalse
+}
+
+func checkIfMatch(req *http.Request, header http.Header) condResult {
+	im := req.Header.Get("If-Match")
+	if im == "" {
+		return condNone
+	}
+	return matchETagList(im, header.Get("Etag"), etagStrongMatch)
+}
+
+func checkIfNoneMatch(req *http.Request, header http.Header) condResult {
+	inm := req.Header.Get("If-None-Match")
+	if inm == "" {
+		return condNone
+	}
+	if matchETagList(inm, header.Get("Etag"), etagWeakMatch) == condTrue {
+		return condFalse
+	}
+	return condTrue
+}
+
+func checkIfUnmodifiedSince(req *http.Request, header http.Header) condResult {
+	ius := req.Header.Get("If-Unmodified-Since")
+	modtime, ok := lastModified(header)
+	if ius == "" || !ok {
+		return condNone
+	}
+	t, err := http.ParseTime(ius)
+	if err != nil {
+		return condNone
+	}
+	if !modtime.After(t) {
+		return condTrue
+	}
+	return condFalse
+}
+
+func checkIfModifiedSince(req *http.Request, header http.Header) condResult {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return condNone
+	}
+	ims := req.Header.Get("If-Modified-Since")
+	modtime, ok := lastModified(header)
+	if ims == "" || !ok {
+		return condNone
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return condNone
+	}
+	if !modtime.After(t) {
+		return condFalse
+	}
+	return condTrue
+}
+
+// lastModified returns the Last-Modified time of the response truncated to seconds
+func lastModified(header http.Header) (time.Time, bool) {
+	modtime, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil || modtime.IsZero() {
+		return time.Time{}, false
+	}
+	return modtime.Truncate(time.Second), true
+}
+
+// checkPreconditions evaluates the request preconditions against the response headers
+// as per RFC 7232 section 6. It returns the status code that must be sent instead
+// of the response or 0 if the response can be sent
+func checkPreconditions(req *http.Request, header http.Header) int {
+	ch := checkIfMatch(req, header)
+	if ch == condNone {
+		ch = checkIfUnmodifiedSince(req, header)
+	}
+	if ch == condFalse {
+		return http.StatusPreconditionFailed
+	}
+
+	switch checkIfNoneMatch(req, header) {
+	case condFalse:
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			return http.StatusNotModified
+		}
+		return http.StatusPreconditionFailed
+	case condNone:
+		if checkIfModifiedSince(req, header) == condFalse {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// writeNotModified sends a 304 response removing the representation metadata
+func writeNotModified(w http.ResponseWriter) {
+	// RFC 7232 section 4.1:
+	// a sender SHOULD NOT generate representation metadata other than the
+	// above listed fields unless said metadata exists for the purpose of
+	// guiding cache updates (e.g., Last-Modified might be useful if the
+	// response does not have an ETag field).
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	delete(h, "Accept-Ranges")
+	if h.Get("Etag") != "" {
+		delete(h, "Last-Modified")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// writePreconditionFailed sends a 412 response without body
+func writePreconditionFailed(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Encoding")
+	delete(h, "Accept-Ranges")
+	h.Set("Content-Length", "0")
+	w.WriteHeader(http.StatusPreconditionFailed)
+}
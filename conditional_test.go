@@ -0,0 +1,122 @@
+package gcsproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScanETag(t *testing.T) {
+	tests := []struct {
+		in, etag, remain string
+	}{
+		{`"abc"`, `"abc"`, ""},
+		{`W/"abc", "def"`, `W/"abc"`, `, "def"`},
+		{`  "abc"`, `"abc"`, ""},
+		{`abc`, "", ""},
+		{`"abc`, "", ""},
+		{`W/abc`, "", ""},
+		{`""`, `""`, ""},
+	}
+	for _, test := range tests {
+		etag, remain := scanETag(test.in)
+		if etag != test.etag || remain != test.remain {
+			t.Errorf("scanETag(%q) = %q, %q, want %q, %q", test.in, etag, remain, test.etag, test.remain)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	const (
+		modified = "Mon, 02 Jan 2006 15:04:05 GMT"
+		before   = "Mon, 02 Jan 2006 15:04:04 GMT"
+		after    = "Mon, 02 Jan 2006 15:04:06 GMT"
+	)
+	header := http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {modified},
+	}
+	weakHeader := http.Header{
+		"Etag":          {`W/"v1"`},
+		"Last-Modified": {modified},
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		header  http.Header
+		request map[string]string
+		want    int
+	}{
+		{"no preconditions", http.MethodGet, header, nil, 0},
+
+		{"if-match strong", http.MethodGet, header, map[string]string{"If-Match": `"v1"`}, 0},
+		{"if-match list", http.MethodGet, header, map[string]string{"If-Match": `"v0", "v1"`}, 0},
+		{"if-match any", http.MethodGet, header, map[string]string{"If-Match": `*`}, 0},
+		{"if-match mismatch", http.MethodGet, header, map[string]string{"If-Match": `"v2"`}, http.StatusPreconditionFailed},
+		// If-Match uses the strong comparison, weak ETags never match
+		{"if-match weak request", http.MethodGet, header, map[string]string{"If-Match": `W/"v1"`}, http.StatusPreconditionFailed},
+		{"if-match weak response", http.MethodGet, weakHeader, map[string]string{"If-Match": `"v1"`}, http.StatusPreconditionFailed},
+
+		{"if-unmodified-since true", http.MethodGet, header, map[string]string{"If-Unmodified-Since": modified}, 0},
+		{"if-unmodified-since false", http.MethodGet, header, map[string]string{"If-Unmodified-Since": before}, http.StatusPreconditionFailed},
+		// If-Match wins over If-Unmodified-Since
+		{"if-match over if-unmodified-since", http.MethodGet, header, map[string]string{"If-Match": `"v1"`, "If-Unmodified-Since": before}, 0},
+		{"invalid if-unmodified-since", http.MethodGet, header, map[string]string{"If-Unmodified-Since": "yesterday"}, 0},
+
+		{"if-none-match match", http.MethodGet, header, map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified},
+		{"if-none-match head", http.MethodHead, header, map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified},
+		{"if-none-match any", http.MethodGet, header, map[string]string{"If-None-Match": `*`}, http.StatusNotModified},
+		{"if-none-match mismatch", http.MethodGet, header, map[string]string{"If-None-Match": `"v2"`}, 0},
+		// If-None-Match uses the weak comparison
+		{"if-none-match weak request", http.MethodGet, header, map[string]string{"If-None-Match": `W/"v1"`}, http.StatusNotModified},
+		{"if-none-match weak response", http.MethodGet, weakHeader, map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified},
+		{"if-none-match unsafe method", http.MethodPut, header, map[string]string{"If-None-Match": `"v1"`}, http.StatusPreconditionFailed},
+
+		{"if-modified-since not modified", http.MethodGet, header, map[string]string{"If-Modified-Since": modified}, http.StatusNotModified},
+		{"if-modified-since later", http.MethodGet, header, map[string]string{"If-Modified-Since": after}, http.StatusNotModified},
+		{"if-modified-since modified", http.MethodGet, header, map[string]string{"If-Modified-Since": before}, 0},
+		{"if-modified-since unsafe method", http.MethodPut, header, map[string]string{"If-Modified-Since": modified}, 0},
+		// If-None-Match wins over If-Modified-Since
+		{"if-none-match mismatch over ims", http.MethodGet, header, map[string]string{"If-None-Match": `"v2"`, "If-Modified-Since": modified}, 0},
+		{"if-none-match match over ims", http.MethodGet, header, map[string]string{"If-None-Match": `"v1"`, "If-Modified-Since": before}, http.StatusNotModified},
+
+		// If-Match is evaluated before If-None-Match
+		{"if-match failure first", http.MethodGet, header, map[string]string{"If-Match": `"v2"`, "If-None-Match": `"v1"`}, http.StatusPreconditionFailed},
+		{"no last-modified", http.MethodGet, http.Header{"Etag": {`"v1"`}}, map[string]string{"If-Modified-Since": modified, "If-Unmodified-Since": before}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/", nil)
+			for name, value := range test.request {
+				req.Header.Set(name, value)
+			}
+			if got := checkPreconditions(req, test.header); got != test.want {
+				t.Errorf("status %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRespondPreconditionFailed(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	entry := newBodyEntry(t, dir, "0123456789")
+	entry.Response.snapHeader.Set("Etag", `"v1"`)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-Match", `"v2"`)
+	w := httptest.NewRecorder()
+	handler := &Handler{Config: emptyConfig(), Stats: &Stats{}}
+	code, err := handler.respond(w, req, entry, cacheHit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPreconditionFailed || w.Body.Len() != 0 {
+		t.Errorf("status %d with %d bytes written, want an empty 412", w.Code, w.Body.Len())
+	}
+	// Caddy writes its own page for the errors returned
+	if code != 0 {
+		t.Errorf("status %d returned after writing the response", code)
+	}
+}
@@ -1,12 +1,14 @@
 package gcsproxy
 
 import (
-	"encoding/json"
+	"cloud.google.com/go/storage"
 	"fmt"
 	"github.com/mholt/caddy"
-	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,6 +18,7 @@ var (
 	defaultLockTimeout  = time.Duration(5) * time.Minute
 	defaultMaxAge       = time.Duration(5) * time.Minute
 	defaultPath         = ""
+	defaultURLExpiry    = time.Duration(5) * time.Minute
 )
 
 // defaultCacheKeyTemplate is the placeholder template that will be used to
@@ -31,19 +34,50 @@ type Config struct {
 	Path             string
 	CacheKeyTemplate string
 	Buckets          []Bucket
+	Routes           []*Route
+	Rewrite          *RewriteConfig
+	TryFiles         []string
+	ErrorPages       ErrorPages
+	Fallthrough      bool
+	NegativeTTL      time.Duration
+	GoogHeaders      *GoogHeaderFilter
+	Endpoint         *url.URL
+	Client           *ClientConfig
+	URLExpiry        time.Duration
+	Redirect         *RedirectConfig
+	Write            *WriteConfig
 	uiPath           string
 	host             string
+	site             string
 	metrics          *Metrics
+
+	// StaleWhileRevalidate and StaleIfError are the defaults of the RFC 5861 directives
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	// RefreshAhead refreshes the hot entries before they expire, nil disables it
+	RefreshAhead *RefreshAheadConfig
+	// MaxSize and MaxEntries bound the cache, 0 means no limit
+	MaxSize    int64
+	MaxEntries int
+	// Eviction is the policy choosing the entries removed when the cache is full
+	Eviction string
+	// The bodies up to MemoryThreshold bytes are kept in memory while they fit in MemoryBudget
+	MemoryThreshold int64
+	MemoryBudget    int64
+	memory          *memoryBudget
 }
 
-// Config specifies configuration parsed for Caddyfile
+// Bucket specifies a bucket where objects are looked up
 type Bucket struct {
 	Name        string
-	Credentials *googleCloudCredential
-}
-type googleCloudCredential struct {
-	GoogleAccessID string `json:"client_email"`
-	PrivateKey     string `json:"private_key"`
+	Credentials CredentialProvider
+	// Endpoint overrides storage.googleapis.com, nil means the default
+	// It is meant for emulators, the URLs sent to it are not signed
+	Endpoint *url.URL
+	// SigningScheme is the version used to sign URLs, V4 by default
+	SigningScheme storage.SigningScheme
+	// URLExpiry is the lifetime of the signed URLs
+	URLExpiry time.Duration
 }
 
 func emptyConfig() *Config {
@@ -54,6 +88,11 @@ func emptyConfig() *Config {
 		CacheRules:       []CacheRule{},
 		Path:             defaultPath,
 		CacheKeyTemplate: defaultCacheKeyTemplate,
+		GoogHeaders:      defaultGoogHeaderFilter(),
+		Client:           defaultClientConfig(),
+		URLExpiry:        defaultURLExpiry,
+		ErrorPages:       ErrorPages{},
+		Eviction:         defaultEvictionPolicy,
 	}
 }
 func parseConfig(c *caddy.Controller) (*Config, error) {
@@ -68,6 +107,7 @@ func parseConfig(c *caddy.Controller) (*Config, error) {
 	}
 	host, _, _ := net.SplitHostPort(c.Key)
 	config.host = host
+	config.site = c.Key
 	for c.NextBlock() {
 		parameter := c.Val()
 		args := c.RemainingArgs()
@@ -118,27 +158,197 @@ func parseConfig(c *caddy.Controller) (*Config, error) {
 				return nil, c.Err("Invalid usage of cache_key in cache config.")
 			}
 			config.CacheKeyTemplate = args[0]
+		case "goog_headers":
+			if len(args) < 1 {
+				return nil, c.Err("Invalid usage of goog_headers in cache config.")
+			}
+			switch args[0] {
+			case "allow":
+				config.GoogHeaders = &GoogHeaderFilter{Allow: true, Names: args[1:]}
+			case "deny":
+				config.GoogHeaders = &GoogHeaderFilter{Allow: false, Names: args[1:]}
+			default:
+				return nil, c.Err("goog_headers: expected allow or deny but got " + args[0])
+			}
 		case "bucket":
-			var bucket Bucket
+			bucket, err := parseBucket(c, args)
+			if err != nil {
+				return nil, err
+			}
+			buckets = append(buckets, bucket)
+		case "route":
+			route, err := parseRoute(c, args)
+			if err != nil {
+				return nil, err
+			}
+			config.Routes = append(config.Routes, route)
+		case "rewrite":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of rewrite in cache config.")
+			}
+			config.Rewrite = &RewriteConfig{}
+			err := parseSubBlock(c, func(parameter string, args []string) error {
+				return parseRewriteParameter(c, config.Rewrite, parameter, args)
+			})
+			if err != nil {
+				return nil, err
+			}
+		case "try_files":
+			if len(args) == 0 {
+				return nil, c.Err("Invalid usage of try_files in cache config.")
+			}
+			config.TryFiles = args
+		case "not_found_object":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of not_found_object in cache config.")
+			}
+			config.ErrorPages["404"] = strings.TrimLeft(args[0], "/")
+		case "error_page":
 			if len(args) != 2 {
-				return nil, c.Err("Invalid usage of cache_key in cache config.")
+				return nil, c.Err("Invalid usage of error_page in cache config.")
+			}
+			if !validErrorStatus(args[0]) {
+				return nil, c.Err("error_page: expected a status code between 400 and 599 or 4xx or 5xx but got " + args[0])
+			}
+			if deniedStatus(args[0]) {
+				return nil, c.Err("error_page: " + args[0] + " is never answered, GCS denials are sent as 502 because they mean the credentials are wrong")
+			}
+			config.ErrorPages[args[0]] = strings.TrimLeft(args[1], "/")
+		case "negative_ttl":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of negative_ttl in cache config.")
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration < 0 {
+				return nil, c.Err("negative_ttl: Invalid duration " + args[0])
+			}
+			config.NegativeTTL = duration
+		case "stale_while_revalidate", "stale_if_error":
+			if len(args) != 1 {
+				return nil, c.Errf("Invalid usage of %s in cache config.", parameter)
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration < 0 {
+				return nil, c.Errf("%s: Invalid duration %s", parameter, args[0])
+			}
+			if parameter == "stale_while_revalidate" {
+				config.StaleWhileRevalidate = duration
+			} else {
+				config.StaleIfError = duration
+			}
+		case "refresh_ahead":
+			if len(args) < 1 || len(args) > 2 {
+				return nil, c.Err("Invalid usage of refresh_ahead in cache config.")
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration <= 0 {
+				return nil, c.Err("refresh_ahead: Invalid duration " + args[0])
+			}
+			config.RefreshAhead = &RefreshAheadConfig{Window: duration}
+			if len(args) == 2 {
+				if args[1] != "probabilistic" {
+					return nil, c.Err("refresh_ahead: expected probabilistic but got " + args[1])
+				}
+				config.RefreshAhead.Probabilistic = true
 			}
-			file := args[1]
-			if _, err := os.Stat(file); os.IsNotExist(err) {
-				return nil, fmt.Errorf("credential file for '%s' %s not exist", args[0], file)
+		case "max_size":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of max_size in cache config.")
 			}
-			data, err := ioutil.ReadFile(file)
+			size, err := parseSize(args[0])
 			if err != nil {
-				return nil, fmt.Errorf("error reading service account key file: %v", err)
+				return nil, c.Err("max_size: " + err.Error())
+			}
+			config.MaxSize = size
+		case "max_entries":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of max_entries in cache config.")
+			}
+			entries, err := strconv.Atoi(args[0])
+			if err != nil || entries < 0 {
+				return nil, c.Err("max_entries: Invalid number " + args[0])
 			}
-			var gcloudCredential = &googleCloudCredential{}
-			err = json.Unmarshal(data, gcloudCredential)
+			config.MaxEntries = entries
+		case "eviction":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of eviction in cache config.")
+			}
+			if _, err := newEvictionPolicy(args[0]); err != nil {
+				return nil, c.Err("eviction: " + err.Error())
+			}
+			config.Eviction = args[0]
+		case "memory_storage":
+			if len(args) != 2 {
+				return nil, c.Err("Invalid usage of memory_storage in cache config.")
+			}
+			threshold, err := parseSize(args[0])
 			if err != nil {
-				return nil, fmt.Errorf("error parsing service account credentials: %v", err)
+				return nil, c.Err("memory_storage: " + err.Error())
+			}
+			budget, err := parseSize(args[1])
+			if err != nil {
+				return nil, c.Err("memory_storage: " + err.Error())
+			}
+			config.MemoryThreshold = threshold
+			config.MemoryBudget = budget
+		case "fallthrough":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of fallthrough in cache config.")
+			}
+			config.Fallthrough = true
+		case "endpoint":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of endpoint in cache config.")
+			}
+			endpoint, err := parseEndpoint(args[0])
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			config.Endpoint = endpoint
+		case "url_expiry":
+			if len(args) != 1 {
+				return nil, c.Err("Invalid usage of url_expiry in cache config.")
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration <= 0 {
+				return nil, c.Err("url_expiry: Invalid duration " + args[0])
+			}
+			config.URLExpiry = duration
+		case "redirect":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of redirect in cache config.")
+			}
+			config.Redirect = defaultRedirectConfig()
+			err := parseSubBlock(c, func(parameter string, args []string) error {
+				return parseRedirectParameter(c, config.Redirect, parameter, args)
+			})
+			if err != nil {
+				return nil, err
+			}
+		case "write":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of write in cache config.")
+			}
+			config.Write = defaultWriteConfig()
+			err := parseSubBlock(c, func(parameter string, args []string) error {
+				return parseWriteParameter(c, config.Write, parameter, args)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(config.Write.AuthRules) == 0 {
+				return nil, c.Err("write: at least one auth rule is required, use auth none to allow any request")
+			}
+		case "client":
+			if len(args) != 0 {
+				return nil, c.Err("Invalid usage of client in cache config.")
+			}
+			err := parseSubBlock(c, func(parameter string, args []string) error {
+				return parseClientParameter(c, config.Client, parameter, args)
+			})
+			if err != nil {
+				return nil, err
 			}
-			bucket.Name = args[0]
-			bucket.Credentials = gcloudCredential
-			buckets = append(buckets, bucket)
 		case "stats":
 			c.Next() // Skip "stats" literal
 			for c.NextBlock() {
@@ -211,6 +421,422 @@ func parseConfig(c *caddy.Controller) (*Config, error) {
 			return nil, c.Err("Unknown cache parameter: " + parameter)
 		}
 	}
+	// Buckets without their own settings use the ones of the block
+	for i := range buckets {
+		if buckets[i].Endpoint == nil {
+			buckets[i].Endpoint = config.Endpoint
+		}
+		if err := buckets[i].resolveSigning(config.URLExpiry); err != nil {
+			return nil, c.Err(err.Error())
+		}
+	}
+	if config.Write != nil && len(buckets) == 0 {
+		return nil, c.Err("write: a bucket is required to write objects")
+	}
 	config.Buckets = buckets
+	for _, route := range config.Routes {
+		if err := route.resolveBuckets(config.Buckets); err != nil {
+			return nil, c.Err(err.Error())
+		}
+	}
 	return config, nil
 }
+
+// storagePath is the directory of the cached files of the site
+// Each site has its own directory, its records are restored only by the same site
+func (config *Config) storagePath() string {
+	path := config.Path
+	if path == "" {
+		path = filepath.Join(os.TempDir(), "caddy-gcs")
+	}
+	if config.site == "" {
+		return path
+	}
+	site := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, config.site)
+	return filepath.Join(path, site)
+}
+
+// negativeTTL is how long missing objects are cached, 0 disables it
+// The fallthrough mode caches them for the default max age unless negative_ttl is set
+func (config *Config) negativeTTL() time.Duration {
+	if config.NegativeTTL == 0 && config.Fallthrough {
+		return config.DefaultMaxAge
+	}
+	return config.NegativeTTL
+}
+
+// parseBucket parses a bucket line and its optional block
+//
+//	bucket <name> [<service account key file>] {
+//	    credentials <provider> [<args>...]
+//	    endpoint <url>
+//	    signing v2|v4
+//	    url_expiry <duration>
+//	}
+func parseBucket(c *caddy.Controller, args []string) (Bucket, error) {
+	var bucket Bucket
+	if len(args) < 1 || len(args) > 2 {
+		return bucket, c.Err("Invalid usage of bucket in cache config.")
+	}
+	bucket.Name = args[0]
+	if len(args) == 2 {
+		credentials, err := newFileCredential(args[1])
+		if err != nil {
+			return bucket, c.Errf("bucket %s: %v", bucket.Name, err)
+		}
+		bucket.Credentials = credentials
+	}
+
+	err := parseSubBlock(c, func(parameter string, args []string) error {
+		switch parameter {
+		case "credentials":
+			if bucket.Credentials != nil {
+				return c.Errf("bucket %s: credentials already set", bucket.Name)
+			}
+			credentials, err := parseCredential(args)
+			if err != nil {
+				return c.Errf("bucket %s: %v", bucket.Name, err)
+			}
+			bucket.Credentials = credentials
+		case "endpoint":
+			if len(args) != 1 {
+				return c.Errf("bucket %s: Invalid usage of endpoint in bucket config.", bucket.Name)
+			}
+			endpoint, err := parseEndpoint(args[0])
+			if err != nil {
+				return c.Errf("bucket %s: %v", bucket.Name, err)
+			}
+			bucket.Endpoint = endpoint
+		case "signing":
+			if len(args) != 1 {
+				return c.Errf("bucket %s: Invalid usage of signing in bucket config.", bucket.Name)
+			}
+			scheme, err := parseSigningScheme(args[0])
+			if err != nil {
+				return c.Errf("bucket %s: %v", bucket.Name, err)
+			}
+			bucket.SigningScheme = scheme
+		case "url_expiry":
+			if len(args) != 1 {
+				return c.Errf("bucket %s: Invalid usage of url_expiry in bucket config.", bucket.Name)
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration <= 0 {
+				return c.Errf("bucket %s: url_expiry: Invalid duration %s", bucket.Name, args[0])
+			}
+			bucket.URLExpiry = duration
+		default:
+			return c.Errf("bucket %s: unknown parameter %s", bucket.Name, parameter)
+		}
+		return nil
+	})
+	if err != nil {
+		return bucket, err
+	}
+
+	if bucket.Credentials == nil {
+		return bucket, c.Errf("bucket %s: no credentials, set a key file or a credentials provider", bucket.Name)
+	}
+	return bucket, nil
+}
+
+// parseRoute parses a route line and its block
+//
+//	route <host> [<path prefix>] {
+//	    buckets <name>...
+//	    object <template>
+//	}
+//
+// A single argument starting with / is a path prefix for any host
+func parseRoute(c *caddy.Controller, args []string) (*Route, error) {
+	route := &Route{Host: "*", PathPrefix: "/", ObjectTemplate: defaultObjectTemplate}
+	switch {
+	case len(args) == 1 && strings.HasPrefix(args[0], "/"):
+		route.PathPrefix = args[0]
+	case len(args) == 1:
+		route.Host = strings.ToLower(args[0])
+	case len(args) == 2:
+		route.Host = strings.ToLower(args[0])
+		route.PathPrefix = args[1]
+	default:
+		return nil, c.Err("Invalid usage of route in cache config.")
+	}
+	if strings.Count(route.Host, "*") > 1 {
+		return nil, c.Errf("route %s: only one * is allowed in the host", route.Host)
+	}
+	if !strings.HasPrefix(route.PathPrefix, "/") {
+		return nil, c.Errf("route %s %s: the path prefix must start with /", route.Host, route.PathPrefix)
+	}
+
+	err := parseSubBlock(c, func(parameter string, args []string) error {
+		switch parameter {
+		case "buckets":
+			if len(args) == 0 {
+				return c.Errf("route %s%s: Invalid usage of buckets in route config.", route.Host, route.PathPrefix)
+			}
+			route.BucketNames = append(route.BucketNames, args...)
+		case "object":
+			if len(args) != 1 {
+				return c.Errf("route %s%s: Invalid usage of object in route config.", route.Host, route.PathPrefix)
+			}
+			route.ObjectTemplate = args[0]
+		default:
+			return c.Errf("route %s%s: unknown parameter %s", route.Host, route.PathPrefix, parameter)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(route.BucketNames) == 0 {
+		return nil, c.Errf("route %s%s: no buckets, set at least one with buckets", route.Host, route.PathPrefix)
+	}
+	return route, nil
+}
+
+func parseRewriteParameter(c *caddy.Controller, rewrite *RewriteConfig, parameter string, args []string) error {
+	if len(args) != 1 {
+		return c.Errf("Invalid usage of %s in rewrite config.", parameter)
+	}
+	switch parameter {
+	case "strip_prefix":
+		rewrite.StripPrefix = strings.TrimLeft(args[0], "/")
+	case "add_prefix":
+		rewrite.AddPrefix = strings.Trim(args[0], "/")
+	case "index":
+		if strings.Contains(args[0], "/") {
+			return c.Err("rewrite index: expected a file name but got " + args[0])
+		}
+		rewrite.IndexDocument = args[0]
+	default:
+		return c.Err("Unknown rewrite parameter: " + parameter)
+	}
+	return nil
+}
+
+func parseRedirectParameter(c *caddy.Controller, redirect *RedirectConfig, parameter string, args []string) error {
+	switch parameter {
+	case "status":
+		if len(args) != 1 {
+			return c.Err("Invalid usage of status in redirect config.")
+		}
+		status, err := strconv.Atoi(args[0])
+		if err != nil || (status != 301 && status != 302 && status != 303 && status != 307 && status != 308) {
+			return c.Err("redirect status: expected a redirect status code but got " + args[0])
+		}
+		redirect.Status = status
+	case "min_size":
+		if len(args) != 1 {
+			return c.Err("Invalid usage of min_size in redirect config.")
+		}
+		size, err := parseSize(args[0])
+		if err != nil {
+			return c.Err("min_size: " + err.Error())
+		}
+		redirect.MinSize = size
+	case "path":
+		if len(args) == 0 {
+			return c.Err("Invalid usage of path in redirect config.")
+		}
+		redirect.Paths = append(redirect.Paths, args...)
+	default:
+		return c.Err("Unknown redirect parameter: " + parameter)
+	}
+	return nil
+}
+
+func parseWriteParameter(c *caddy.Controller, write *WriteConfig, parameter string, args []string) error {
+	switch parameter {
+	case "methods":
+		if len(args) == 0 {
+			return c.Err("Invalid usage of methods in write config.")
+		}
+		for _, method := range args {
+			method = strings.ToUpper(method)
+			if method != "PUT" && method != "POST" && method != "DELETE" {
+				return c.Err("write methods: unsupported method " + method)
+			}
+		}
+		write.Methods = nil
+		for _, method := range args {
+			write.Methods = append(write.Methods, strings.ToUpper(method))
+		}
+	case "path":
+		if len(args) == 0 {
+			return c.Err("Invalid usage of path in write config.")
+		}
+		write.Paths = append(write.Paths, args...)
+	case "auth":
+		if len(args) == 0 {
+			return c.Err("Invalid usage of auth in write config.")
+		}
+		switch args[0] {
+		case "header":
+			if len(args) != 3 {
+				return c.Err("auth header: expected header name and value")
+			}
+			write.AuthRules = append(write.AuthRules, &HeaderAuthRule{Header: args[1], Value: args[2]})
+		case "basic":
+			if len(args) != 3 {
+				return c.Err("auth basic: expected user and password")
+			}
+			write.AuthRules = append(write.AuthRules, &BasicAuthRule{User: args[1], Password: args[2]})
+		case "none":
+			if len(args) != 1 {
+				return c.Err("auth none: unexpected arguments")
+			}
+			write.AuthRules = append(write.AuthRules, &AnyAuthRule{})
+		default:
+			return c.Err("auth: unknown rule " + args[0])
+		}
+	case "resumable_threshold":
+		if len(args) != 1 {
+			return c.Err("Invalid usage of resumable_threshold in write config.")
+		}
+		size, err := parseSize(args[0])
+		if err != nil {
+			return c.Err("resumable_threshold: " + err.Error())
+		}
+		write.ResumableThreshold = size
+	case "chunk_size":
+		if len(args) != 1 {
+			return c.Err("Invalid usage of chunk_size in write config.")
+		}
+		size, err := parseSize(args[0])
+		if err != nil {
+			return c.Err("chunk_size: " + err.Error())
+		}
+		if size <= 0 || size%resumableChunkMultiple != 0 {
+			return c.Errf("chunk_size: must be a multiple of %d bytes", resumableChunkMultiple)
+		}
+		write.ChunkSize = size
+	default:
+		return c.Err("Unknown write parameter: " + parameter)
+	}
+	return nil
+}
+
+// parseSize parses a size in bytes with an optional unit: 512, 10KB, 5MiB, 1GB
+func parseSize(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+		{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000}, {"TB", 1000 * 1000 * 1000 * 1000},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+		{"B", 1},
+	}
+	upper := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %s", value)
+	}
+	return size * multiplier, nil
+}
+
+func parseClientParameter(c *caddy.Controller, client *ClientConfig, parameter string, args []string) error {
+	switch parameter {
+	case "connect_timeout", "header_timeout", "idle_timeout":
+		if len(args) != 1 {
+			return c.Errf("Invalid usage of %s in client config.", parameter)
+		}
+		duration, err := time.ParseDuration(args[0])
+		if err != nil {
+			return c.Errf("%s: Invalid duration %s", parameter, args[0])
+		}
+		switch parameter {
+		case "connect_timeout":
+			client.ConnectTimeout = duration
+		case "header_timeout":
+			client.HeaderTimeout = duration
+		case "idle_timeout":
+			client.IdleTimeout = duration
+		}
+	case "max_idle_conns", "max_idle_conns_per_host", "retries":
+		if len(args) != 1 {
+			return c.Errf("Invalid usage of %s in client config.", parameter)
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value < 0 {
+			return c.Errf("%s: Invalid number %s", parameter, args[0])
+		}
+		switch parameter {
+		case "max_idle_conns":
+			client.MaxIdleConns = value
+		case "max_idle_conns_per_host":
+			client.MaxIdleConnsPerHost = value
+		case "retries":
+			client.Retries = value
+		}
+	case "backoff":
+		if len(args) != 2 {
+			return c.Err("Invalid usage of backoff in client config, expected base and max delays.")
+		}
+		base, err := time.ParseDuration(args[0])
+		if err != nil {
+			return c.Err("backoff: Invalid duration " + args[0])
+		}
+		max, err := time.ParseDuration(args[1])
+		if err != nil {
+			return c.Err("backoff: Invalid duration " + args[1])
+		}
+		if base > max {
+			return c.Err("backoff: base delay is greater than max delay")
+		}
+		client.RetryBaseDelay = base
+		client.RetryMaxDelay = max
+	default:
+		return c.Err("Unknown client parameter: " + parameter)
+	}
+	return nil
+}
+
+// validErrorStatus checks the status of an error page, a code or a class of errors
+func validErrorStatus(status string) bool {
+	if status == "4xx" || status == "5xx" {
+		return true
+	}
+	code, err := strconv.Atoi(status)
+	return err == nil && code >= 400 && code <= 599
+}
+
+// deniedStatus returns if the status is a denial of GCS, 401 or 403
+// Denials are answered with 502 like any other upstream failure, so their pages would never be served
+func deniedStatus(status string) bool {
+	return status == "401" || status == "403"
+}
+
+// parseSubBlock calls fn for each line of the block opened at the end of the current line
+// Unlike NextBlock it can be used inside another block
+func parseSubBlock(c *caddy.Controller, fn func(parameter string, args []string) error) error {
+	if !c.NextArg() {
+		return nil
+	}
+	if c.Val() != "{" {
+		return c.ArgErr()
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			return nil
+		}
+		if err := fn(c.Val(), c.RemainingArgs()); err != nil {
+			return err
+		}
+	}
+	return c.EOFErr()
+}
@@ -0,0 +1,161 @@
+package gcsproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"cloud.google.com/go/storage"
+)
+
+// CredentialProvider gives access to the objects of a bucket
+type CredentialProvider interface {
+	// Name identifies the provider in logs and errors
+	Name() string
+	// SignedURL returns the URL to request the object with the given options.
+	// The provider fills the credentials of the options.
+	SignedURL(bucket, object string, opts *storage.SignedURLOptions) (string, error)
+}
+
+// googleCloudCredential signs URLs with the key of a service account
+type googleCloudCredential struct {
+	GoogleAccessID string `json:"client_email"`
+	PrivateKey     string `json:"private_key"`
+
+	source string
+}
+
+// hmacCredential signs URLs with an HMAC interoperability key
+type hmacCredential struct {
+	AccessID string
+	Secret   string
+}
+
+// anonymousCredential does not sign URLs, the bucket must be public
+type anonymousCredential struct{}
+
+// parseServiceAccount reads the client email and private key from a service account JSON key
+func parseServiceAccount(data []byte, source string) (*googleCloudCredential, error) {
+	var gcloudCredential = &googleCloudCredential{source: source}
+	if err := json.Unmarshal(data, gcloudCredential); err != nil {
+		return nil, fmt.Errorf("error parsing service account credentials from %s: %v", source, err)
+	}
+	if gcloudCredential.GoogleAccessID == "" || gcloudCredential.PrivateKey == "" {
+		return nil, fmt.Errorf("credentials from %s are not a service account key, client_email and private_key are required", source)
+	}
+	return gcloudCredential, nil
+}
+
+// newFileCredential reads a service account key file
+func newFileCredential(file string) (*googleCloudCredential, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, fmt.Errorf("credential file %s does not exist", file)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading service account key file: %v", err)
+	}
+	return parseServiceAccount(data, "file "+file)
+}
+
+// newEnvCredential reads a service account key from an environment variable
+func newEnvCredential(name string) (*googleCloudCredential, error) {
+	data := os.Getenv(name)
+	if data == "" {
+		return nil, fmt.Errorf("environment variable %s is empty", name)
+	}
+	return parseServiceAccount([]byte(data), "environment variable "+name)
+}
+
+// newApplicationDefaultCredential reads the key file in GOOGLE_APPLICATION_CREDENTIALS
+func newApplicationDefaultCredential() (*googleCloudCredential, error) {
+	file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if file == "" {
+		return nil, errors.New("GOOGLE_APPLICATION_CREDENTIALS is not set")
+	}
+	return newFileCredential(file)
+}
+
+func (c *googleCloudCredential) Name() string {
+	return "service account " + c.GoogleAccessID + " from " + c.source
+}
+
+func (c *googleCloudCredential) SignedURL(bucket, object string, opts *storage.SignedURLOptions) (string, error) {
+	opts.GoogleAccessID = c.GoogleAccessID
+	opts.PrivateKey = []byte(c.PrivateKey)
+	return storage.SignedURL(bucket, object, opts)
+}
+
+func (c *hmacCredential) Name() string {
+	return "hmac key " + c.AccessID
+}
+
+func (c *hmacCredential) SignedURL(bucket, object string, opts *storage.SignedURLOptions) (string, error) {
+	opts.GoogleAccessID = c.AccessID
+	opts.SignBytes = func(b []byte) ([]byte, error) {
+		mac := hmac.New(sha1.New, []byte(c.Secret))
+		mac.Write(b)
+		return mac.Sum(nil), nil
+	}
+	return storage.SignedURL(bucket, object, opts)
+}
+
+func (c *anonymousCredential) Name() string {
+	return "anonymous"
+}
+
+func (c *anonymousCredential) SignedURL(bucket, object string, opts *storage.SignedURLOptions) (string, error) {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   "storage.googleapis.com",
+		Path:   fmt.Sprintf("/%s/%s", bucket, object),
+	}
+	return u.String(), nil
+}
+
+// parseCredential creates the provider for the arguments of a credentials line
+func parseCredential(args []string) (CredentialProvider, error) {
+	if len(args) == 0 {
+		return nil, errors.New("credentials: missing provider")
+	}
+	provider, args := args[0], args[1:]
+	switch provider {
+	case "file":
+		if len(args) != 1 {
+			return nil, errors.New("credentials file: expected a path")
+		}
+		return newFileCredential(args[0])
+	case "env":
+		if len(args) != 1 {
+			return nil, errors.New("credentials env: expected a variable name")
+		}
+		return newEnvCredential(args[0])
+	case "json":
+		if len(args) != 1 {
+			return nil, errors.New("credentials json: expected the key as a single argument")
+		}
+		return parseServiceAccount([]byte(args[0]), "inline json")
+	case "application_default":
+		if len(args) != 0 {
+			return nil, errors.New("credentials application_default: unexpected arguments")
+		}
+		return newApplicationDefaultCredential()
+	case "hmac":
+		if len(args) != 2 {
+			return nil, errors.New("credentials hmac: expected access id and secret")
+		}
+		return &hmacCredential{AccessID: args[0], Secret: args[1]}, nil
+	case "anonymous":
+		if len(args) != 0 {
+			return nil, errors.New("credentials anonymous: unexpected arguments")
+		}
+		return &anonymousCredential{}, nil
+	default:
+		return nil, fmt.Errorf("credentials: unknown provider %s", provider)
+	}
+}
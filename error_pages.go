@@ -0,0 +1,107 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// errorPagesKeyTemplate is the cache key of the error pages, they do not depend on the requested URL
+const errorPagesKeyTemplate = "{host}{rewrite_path}"
+
+// ErrorPages maps status codes to the objects served as their body, like GCS static website hosting
+// The keys are status codes like 404 or classes like 5xx, the objects are looked up in the buckets of the request
+type ErrorPages map[string]string
+
+// object returns the page of the status code, the exact code wins over its class
+func (pages ErrorPages) object(code int) string {
+	if object, ok := pages[strconv.Itoa(code)]; ok {
+		return object
+	}
+	return pages[fmt.Sprintf("%dxx", code/100)]
+}
+
+// findErrorPage fetches the error page of the status code from the buckets of the target
+// A nil response means there is no page, errors fetching it are only logged
+func (handler *Handler) findErrorPage(req *http.Request, t *target, code int, method string) *http.Response {
+	object := handler.Config.ErrorPages.object(code)
+	if object == "" {
+		return nil
+	}
+
+	page := &target{buckets: t.buckets, object: object, candidates: []string{object}}
+	_, _, res, err := handler.findObject(req, page, method)
+	if err != nil {
+		log.Printf("[ERROR] gcs: fetching error page %s: %v", object, err)
+		return nil
+	}
+	if res == nil {
+		log.Printf("[WARNING] gcs: error page %s for status %d does not exist", object, code)
+		return nil
+	}
+
+	// The validators belong to the page, not to the requested URL
+	res.Header.Del("ETag")
+	res.Header.Del("Last-Modified")
+	return res
+}
+
+// errorPageRequest returns the request used to cache the page of the target
+// The buckets are part of the key because each route can have its own page
+func errorPageRequest(r *http.Request, t *target, object string) *http.Request {
+	names := make([]string, len(t.buckets))
+	for i, bucket := range t.buckets {
+		names[i] = bucket.Name
+	}
+
+	pageReq := requestWithMethod(r, http.MethodGet)
+	pageReq.URL = &url.URL{Path: "/" + strings.Join(names, ",") + "/" + object}
+	return pageReq
+}
+
+// serveError answers with the error page of the status code if there is one.
+// The pages are cached like any other object. Without page the status is returned
+// so Caddy writes the error
+func (handler *Handler) serveError(w http.ResponseWriter, r *http.Request, code int, err error) (int, error) {
+	object := handler.Config.ErrorPages.object(code)
+	if object == "" {
+		return code, err
+	}
+
+	t := handler.target(r)
+	pageReq := errorPageRequest(r, t, object)
+	entry, exists := handler.ErrorPageCache.Get(pageReq)
+	if !exists {
+		res := handler.findErrorPage(r, t, code, http.MethodGet)
+		if res == nil {
+			return code, err
+		}
+		entry = NewHTTPCacheEntry(getKey(errorPagesKeyTemplate, pageReq), pageReq, handler.proxyResponse(pageReq, res, http.StatusOK), handler.Config)
+		if entry.isPublic {
+			// The body was already given to the failed storage, the page can not be written
+			if storageErr := entry.setStorage(handler.Config); storageErr != nil {
+				log.Printf("[ERROR] gcs: storing error page %s: %v", object, storageErr)
+				return code, err
+			}
+			handler.ErrorPageCache.Put(pageReq, entry)
+		}
+	}
+
+	copyHeaders(entry.Response.snapHeader, w.Header())
+	// The error is temporary, only the pages of client errors can be stored
+	if code >= 500 {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	w.WriteHeader(code)
+	if r.Method == http.MethodHead && entry.isPublic {
+		return 0, err
+	}
+	if writeErr := entry.WriteBodyTo(w); writeErr != nil {
+		log.Printf("[ERROR] gcs: writing error page %s: %v", object, writeErr)
+	}
+	// The response is already written
+	return 0, err
+}
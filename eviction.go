@@ -0,0 +1,212 @@
+package gcsproxy
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+const (
+	evictionLRU  = "lru"
+	evictionLFU  = "lfu"
+	evictionSize = "size"
+)
+
+var defaultEvictionPolicy = evictionLRU
+
+// EvictionPolicy chooses the entries removed when the cache is full
+// The cache serializes the calls, the policies do not need to be safe for concurrent use
+type EvictionPolicy interface {
+	// Name identifies the policy in the metrics
+	Name() string
+	// Add starts tracking an entry of the given size in bytes
+	Add(entry *HTTPCacheEntry, size int64)
+	// Touch records a hit of the entry
+	Touch(entry *HTTPCacheEntry)
+	// Remove stops tracking the entry, it does nothing if the entry is not tracked
+	Remove(entry *HTTPCacheEntry)
+	// Victim returns the entry to evict next or nil if there are no entries
+	Victim() *HTTPCacheEntry
+}
+
+// newEvictionPolicy creates the policy with the given name
+func newEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case evictionLRU:
+		return newLRUPolicy(), nil
+	case evictionLFU:
+		return newPriorityPolicy(evictionLFU, func(item *priorityItem, floor float64) float64 {
+			return float64(item.hits)
+		}), nil
+	case evictionSize:
+		// GreedyDual-Size: big entries are evicted first unless they keep being hit,
+		// the floor ages the priority of the entries that are not hit anymore
+		return newPriorityPolicy(evictionSize, func(item *priorityItem, floor float64) float64 {
+			size := item.size
+			if size < 1 {
+				size = 1
+			}
+			return floor + 1/float64(size)
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %s, expected lru, lfu or size", name)
+	}
+}
+
+// lruPolicy evicts the least recently used entry
+type lruPolicy struct {
+	order    *list.List
+	elements map[*HTTPCacheEntry]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		order:    list.New(),
+		elements: make(map[*HTTPCacheEntry]*list.Element),
+	}
+}
+
+func (p *lruPolicy) Name() string {
+	return evictionLRU
+}
+
+func (p *lruPolicy) Add(entry *HTTPCacheEntry, size int64) {
+	if element, ok := p.elements[entry]; ok {
+		p.order.MoveToFront(element)
+		return
+	}
+	p.elements[entry] = p.order.PushFront(entry)
+}
+
+func (p *lruPolicy) Touch(entry *HTTPCacheEntry) {
+	if element, ok := p.elements[entry]; ok {
+		p.order.MoveToFront(element)
+	}
+}
+
+func (p *lruPolicy) Remove(entry *HTTPCacheEntry) {
+	if element, ok := p.elements[entry]; ok {
+		p.order.Remove(element)
+		delete(p.elements, entry)
+	}
+}
+
+func (p *lruPolicy) Victim() *HTTPCacheEntry {
+	element := p.order.Back()
+	if element == nil {
+		return nil
+	}
+	return element.Value.(*HTTPCacheEntry)
+}
+
+// priorityItem is an entry tracked by a priorityPolicy
+type priorityItem struct {
+	entry    *HTTPCacheEntry
+	size     int64
+	hits     uint64
+	priority float64
+	// seq breaks the ties, the oldest used entry is evicted first
+	seq   uint64
+	index int
+}
+
+// priorityPolicy evicts the entry with the lowest priority
+type priorityPolicy struct {
+	name     string
+	priority func(item *priorityItem, floor float64) float64
+	items    priorityQueue
+	byEntry  map[*HTTPCacheEntry]*priorityItem
+	seq      uint64
+	// floor is the priority of the last victim
+	floor float64
+}
+
+func newPriorityPolicy(name string, priority func(item *priorityItem, floor float64) float64) *priorityPolicy {
+	return &priorityPolicy{
+		name:     name,
+		priority: priority,
+		byEntry:  make(map[*HTTPCacheEntry]*priorityItem),
+	}
+}
+
+func (p *priorityPolicy) Name() string {
+	return p.name
+}
+
+func (p *priorityPolicy) Add(entry *HTTPCacheEntry, size int64) {
+	if item, ok := p.byEntry[entry]; ok {
+		item.size = size
+		p.update(item)
+		return
+	}
+	item := &priorityItem{entry: entry, size: size}
+	p.seq++
+	item.seq = p.seq
+	item.priority = p.priority(item, p.floor)
+	p.byEntry[entry] = item
+	heap.Push(&p.items, item)
+}
+
+func (p *priorityPolicy) Touch(entry *HTTPCacheEntry) {
+	if item, ok := p.byEntry[entry]; ok {
+		item.hits++
+		p.update(item)
+	}
+}
+
+func (p *priorityPolicy) update(item *priorityItem) {
+	p.seq++
+	item.seq = p.seq
+	item.priority = p.priority(item, p.floor)
+	heap.Fix(&p.items, item.index)
+}
+
+func (p *priorityPolicy) Remove(entry *HTTPCacheEntry) {
+	if item, ok := p.byEntry[entry]; ok {
+		heap.Remove(&p.items, item.index)
+		delete(p.byEntry, entry)
+	}
+}
+
+func (p *priorityPolicy) Victim() *HTTPCacheEntry {
+	if len(p.items) == 0 {
+		return nil
+	}
+	item := p.items[0]
+	if item.priority > p.floor {
+		p.floor = item.priority
+	}
+	return item.entry
+}
+
+// priorityQueue implements heap.Interface, the lowest priority is the first item
+type priorityQueue []*priorityItem
+
+func (q priorityQueue) Len() int { return len(q) }
+
+func (q priorityQueue) Less(i, j int) bool {
+	if q[i].priority == q[j].priority {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].priority < q[j].priority
+}
+
+func (q priorityQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *priorityQueue) Push(x interface{}) {
+	item := x.(*priorityItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *priorityQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,225 @@
+package gcsproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestEntry returns a fresh public entry, a negative size means the Content-Length is unknown
+func newTestEntry(key string, size int64) *HTTPCacheEntry {
+	response := NewResponse()
+	if size >= 0 {
+		response.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	response.WriteHeader(http.StatusOK)
+	return &HTTPCacheEntry{
+		isPublic:   true,
+		key:        key,
+		expiration: time.Now().Add(time.Hour),
+		Request:    httptest.NewRequest(http.MethodGet, "/"+key, nil),
+		Response:   response,
+	}
+}
+
+// drain returns the keys of the entries in the order the policy evicts them
+func drain(policy EvictionPolicy) []string {
+	var keys []string
+	for entry := policy.Victim(); entry != nil; entry = policy.Victim() {
+		keys = append(keys, entry.Key())
+		policy.Remove(entry)
+	}
+	return keys
+}
+
+func TestEvictionPolicyVictims(t *testing.T) {
+	type op struct {
+		touch string
+		add   string
+		size  int64
+	}
+	add := func(key string, size int64) op { return op{add: key, size: size} }
+	touch := func(key string) op { return op{touch: key} }
+
+	tests := []struct {
+		name   string
+		policy string
+		ops    []op
+		want   []string
+	}{
+		{"lru insertion order", evictionLRU, []op{add("a", 1), add("b", 1), add("c", 1)}, []string{"a", "b", "c"}},
+		{"lru touch moves to front", evictionLRU, []op{add("a", 1), add("b", 1), add("c", 1), touch("a"), touch("b")}, []string{"c", "a", "b"}},
+		{"lru re-add moves to front", evictionLRU, []op{add("a", 1), add("b", 1), add("a", 1)}, []string{"b", "a"}},
+		{"lfu least hits first", evictionLFU, []op{add("a", 1), add("b", 1), add("c", 1), touch("a"), touch("a"), touch("c")}, []string{"b", "c", "a"}},
+		{"lfu ties by oldest use", evictionLFU, []op{add("a", 1), add("b", 1), touch("b"), touch("a")}, []string{"b", "a"}},
+		{"lfu ignores size", evictionLFU, []op{add("big", 1000), add("small", 1), touch("big")}, []string{"small", "big"}},
+		{"size biggest first", evictionSize, []op{add("a", 100), add("b", 10), add("c", 1000)}, []string{"c", "a", "b"}},
+		{"size unknown counts as one byte", evictionSize, []op{add("empty", 0), add("a", 2)}, []string{"a", "empty"}},
+		{"size touch does not change size priority", evictionSize, []op{add("a", 10), add("b", 100), touch("b")}, []string{"b", "a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := newEvictionPolicy(test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := map[string]*HTTPCacheEntry{}
+			for _, op := range test.ops {
+				if op.add != "" {
+					if entries[op.add] == nil {
+						entries[op.add] = newTestEntry(op.add, op.size)
+					}
+					policy.Add(entries[op.add], op.size)
+				} else {
+					policy.Touch(entries[op.touch])
+				}
+			}
+			if got := drain(policy); !equalStrings(got, test.want) {
+				t.Errorf("victims %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestEvictionSizeAging checks that the entries added after an eviction
+// start from the priority of the victim, so old small entries are evicted eventually
+func TestEvictionSizeAging(t *testing.T) {
+	policy, _ := newEvictionPolicy(evictionSize)
+	old := newTestEntry("old", 10)
+	big := newTestEntry("big", 1000)
+	policy.Add(old, 10)
+	policy.Add(big, 1000)
+
+	for i := 0; i < 200; i++ {
+		victim := policy.Victim()
+		if victim == old {
+			return
+		}
+		policy.Remove(victim)
+		policy.Add(newTestEntry("new"+strconv.Itoa(i), 1000), 1000)
+	}
+	t.Errorf("the old entry was never evicted")
+}
+
+func TestEvictionPolicyUnknown(t *testing.T) {
+	if _, err := newEvictionPolicy("fifo"); err == nil {
+		t.Errorf("expected an error for an unknown policy")
+	}
+}
+
+func TestCacheLimitsAccounting(t *testing.T) {
+	cache := NewHTTPCache(defaultCacheKeyTemplate)
+	cache.SetLimits(0, 0, newLRUPolicy())
+	limits := cache.limits
+	check := func(step string, size int64, entries int) {
+		t.Helper()
+		limits.mutex.Lock()
+		defer limits.mutex.Unlock()
+		if limits.size != size || len(limits.sizes) != entries {
+			t.Errorf("%s: size %d with %d entries, want %d with %d", step, limits.size, len(limits.sizes), size, entries)
+		}
+	}
+
+	a := newTestEntry("a", 10)
+	cache.Put(a.Request, a)
+	check("put a", 10, 1)
+
+	b := newTestEntry("b", 5)
+	cache.Put(b.Request, b)
+	check("put b", 15, 2)
+
+	// Same key and Vary, the previous entry is replaced
+	replacement := newTestEntry("a", 3)
+	cache.Put(replacement.Request, replacement)
+	check("replace a", 8, 2)
+
+	// The replaced entry is not tracked anymore
+	cache.untrack(a)
+	check("untrack replaced", 8, 2)
+
+	cache.Delete("b")
+	check("delete b", 3, 1)
+
+	cache.removeEntry(replacement)
+	check("remove a", 0, 0)
+}
+
+func TestCacheLimitsResize(t *testing.T) {
+	cache := NewHTTPCache(defaultCacheKeyTemplate)
+	cache.SetLimits(0, 0, newLRUPolicy())
+
+	entry := newTestEntry("unknown", -1)
+	cache.Put(entry.Request, entry)
+	if size, known := entry.size(); known || size != 0 {
+		t.Fatalf("size %d known %v before the body is written", size, known)
+	}
+
+	atomic.StoreInt64(&entry.Response.written, 42)
+	entry.Response.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		cache.limits.mutex.Lock()
+		size := cache.limits.size
+		cache.limits.mutex.Unlock()
+		if size == 42 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("the size was not updated when the body was complete")
+}
+
+func TestCacheEvictsOverLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxEntries int
+		sizes      []int64
+		want       []string
+	}{
+		{"max entries", 0, 2, []int64{1, 1, 1}, []string{"1", "2"}},
+		{"max size", 10, 0, []int64{4, 4, 4}, []string{"1", "2"}},
+		{"both", 100, 2, []int64{60, 30, 20}, []string{"1", "2"}},
+		{"bigger than max size", 10, 0, []int64{5, 20}, []string{"0"}},
+	}
+	// evict counts the evictions
+	NewMetrics().define("")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := NewHTTPCache(defaultCacheKeyTemplate)
+			cache.SetLimits(test.maxSize, test.maxEntries, newLRUPolicy())
+			for i, size := range test.sizes {
+				entry := newTestEntry(strconv.Itoa(i), size)
+				cache.Put(entry.Request, entry)
+			}
+
+			var got []string
+			for i := range test.sizes {
+				key := strconv.Itoa(i)
+				bucket := cache.getBucketIndexForKey(key)
+				if len(cache.entries[bucket][key]) > 0 {
+					got = append(got, key)
+				}
+			}
+			if !equalStrings(got, test.want) {
+				t.Errorf("kept %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
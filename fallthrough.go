@@ -0,0 +1,17 @@
+package gcsproxy
+
+import (
+	"net/http"
+)
+
+// serveNext passes the request of a missing object to the next handler
+// The entry is never sent to the client
+func (handler *Handler) serveNext(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry) (int, error) {
+	// Private entries wait for a body before closing, they are released writing the empty body
+	if !entry.isPublic {
+		if err := entry.WriteBodyTo(w); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return handler.Next.ServeHTTP(w, r)
+}
@@ -1,11 +1,10 @@
 package gcsproxy
 
 import (
-	"cloud.google.com/go/storage"
-	"fmt"
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
-	"io/ioutil"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"strconv"
@@ -27,13 +26,24 @@ type Handler struct {
 	// Handles locking for different URLs
 	URLLocks *URLLock
 	Stats    *Stats
+
+	// Client sends the requests to GCS
+	Client *UpstreamClient
+
+	// ErrorPageCache stores the error pages apart from the requested URLs
+	ErrorPageCache *HTTPCache
+
+	revalidations *revalidations
 }
 
 const (
-	cacheHit    = "hit"
-	cacheMiss   = "miss"
-	cacheSkip   = "skip"
-	cacheBypass = "bypass"
+	cacheHit      = "hit"
+	cacheMiss     = "miss"
+	cacheSkip     = "skip"
+	cacheBypass   = "bypass"
+	cacheRedirect = "redirect"
+	// cacheNegative is a hit of a missing object
+	cacheNegative = "negative"
 )
 
 var (
@@ -46,7 +56,13 @@ var (
 		"path_prefix",
 		"mitm",
 	}
-	defaultExpire = 300
+)
+
+const (
+	// upstreamBufferSize is the size of each chunk read from upstream
+	upstreamBufferSize = 32 * 1024
+	// upstreamFlushSize is the amount of bytes written between flushes
+	upstreamFlushSize = 1024 * 1024
 )
 
 func getKey(cacheKeyTemplate string, r *http.Request) string {
@@ -55,13 +71,36 @@ func getKey(cacheKeyTemplate string, r *http.Request) string {
 
 // NewHandler creates a new Handler using Next middleware
 func NewHandler(Next httpserver.Handler, config *Config) *Handler {
-	return &Handler{
+	handler := &Handler{
 		Config:   config,
 		Cache:    NewHTTPCache(config.CacheKeyTemplate),
 		URLLocks: NewURLLock(),
 		Next:     Next,
 		Stats:    &Stats{},
+		Client:   NewUpstreamClient(config.Client),
+
+		ErrorPageCache: NewHTTPCache(errorPagesKeyTemplate),
+		revalidations:  newRevalidations(),
 	}
+	if config.MaxSize > 0 || config.MaxEntries > 0 {
+		// The policy was validated parsing the configuration
+		policy, err := newEvictionPolicy(config.Eviction)
+		if err != nil {
+			policy = newLRUPolicy()
+		}
+		handler.Cache.SetLimits(config.MaxSize, config.MaxEntries, policy)
+	}
+
+	config.memory = newMemoryBudget(config.MemoryThreshold, config.MemoryBudget)
+
+	path := config.storagePath()
+	restored, err := handler.Cache.Restore(path)
+	if err != nil {
+		log.Printf("[ERROR] gcs: restoring the cache from %s: %v", path, err)
+	} else if restored > 0 {
+		log.Printf("[INFO] gcs: restoring %d cached entries from %s", restored, path)
+	}
+	return handler
 }
 
 /* Responses */
@@ -85,14 +124,51 @@ func (handler *Handler) addStatusHeaderIfConfigured(w http.ResponseWriter, statu
 	}
 }
 
-func (handler *Handler) respond(w http.ResponseWriter, entry *HTTPCacheEntry, cacheStatus string) (int, error) {
+func (handler *Handler) respond(w http.ResponseWriter, req *http.Request, entry *HTTPCacheEntry, cacheStatus string) (int, error) {
 	handler.addStatusHeaderIfConfigured(w, cacheStatus)
 
+	// Missing objects are answered by the next handler
+	if handler.Config.Fallthrough && entry.Response.Code == http.StatusNotFound {
+		return handler.serveNext(w, req, entry)
+	}
+
 	copyHeaders(entry.Response.snapHeader, w.Header())
+
+	// Validators are only checked against cached entries
+	if entry.isPublic && entry.Response.Code == http.StatusOK {
+		switch checkPreconditions(req, entry.Response.snapHeader) {
+		case http.StatusNotModified:
+			writeNotModified(w)
+			return http.StatusNotModified, nil
+		case http.StatusPreconditionFailed:
+			writePreconditionFailed(w)
+			// The response is already written
+			return 0, nil
+		}
+	}
+
+	// Range requests can only be served from a public entry with a known size
+	// Otherwise the whole response is sent
+	if size, ok := rangeRequestable(entry); ok {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if req.Header.Get("Range") != "" && checkIfRange(req, entry.Response.snapHeader) {
+			return handler.respondRange(w, req, entry, size)
+		}
+	}
+
 	w.WriteHeader(entry.Response.Code)
 
+	// Cached bodies are not needed to answer HEAD requests
+	if req.Method == http.MethodHead && entry.isPublic {
+		return entry.Response.Code, nil
+	}
+
 	err := entry.WriteBodyTo(w)
 
+	// The body of errors with a page is already written, Caddy must not add its own
+	if entry.Response.Code >= 400 && handler.Config.ErrorPages.object(entry.Response.Code) != "" {
+		return 0, err
+	}
 	return entry.Response.Code, err
 }
 
@@ -106,13 +182,6 @@ func shouldUseCache(req *http.Request) bool {
 		return false
 	}
 
-	// Range requests still not supported
-	// It may happen that the previous request for this url has a successful response
-	// but for another Range. So a special handling is needed
-	if req.Header.Get("range") != "" {
-		return false
-	}
-
 	if strings.ToLower(req.Header.Get("Connection")) == "upgrade" && strings.ToLower(req.Header.Get("Upgrade")) == "websocket" {
 		return false
 	}
@@ -120,61 +189,133 @@ func shouldUseCache(req *http.Request) bool {
 	return true
 }
 
-func popOrNil(errChan chan error) (err error) {
-	select {
-	case err = <-errChan:
-	default:
+// copyBody streams the upstream body into the response in chunks.
+// The response is flushed periodically so readers of the storage
+// and clients of private responses receive the body while it is downloaded.
+func copyBody(response *Response, body io.Reader) (int64, error) {
+	buf := make([]byte, upstreamBufferSize)
+	var written, unflushed int64
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := response.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+			unflushed += int64(n)
+			if unflushed >= upstreamFlushSize {
+				response.Flush()
+				unflushed = 0
+			}
+		}
+		if readErr == io.EOF {
+			response.Flush()
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
 	}
-	return
 }
 
-func (handler *Handler) fetchUpstream(req *http.Request) (*HTTPCacheEntry, error) {
-	// Create a new empty response
-	response := NewResponse()
-	errChan := make(chan error, 1)
-	var found = false
-	var res *http.Response
-	go func(req *http.Request, response *Response) {
-		for _, bucket := range handler.Config.Buckets {
-			expires := time.Now().Add(time.Duration(defaultExpire) * time.Second)
-			signedURLOptions := storage.SignedURLOptions{
-				GoogleAccessID: bucket.Credentials.GoogleAccessID,
-				PrivateKey:     []byte(bucket.Credentials.PrivateKey),
-				Method:         "GET",
-				Expires:        expires,
+// findObject looks up the candidates of the target in every bucket in order and returns the first one found,
+// the bucket and the name of the object. A nil response without error means every lookup answered 404
+func (handler *Handler) findObject(req *http.Request, t *target, method string) (*Bucket, string, *http.Response, error) {
+	var firstErr error
+	for _, object := range t.candidates {
+		for _, bucket := range t.buckets {
+			res, err := bucket.fetch(handler.Client, method, object, req)
+			if err == nil {
+				return bucket, object, res, nil
 			}
-			object := strings.TrimLeft(req.URL.Path, "/")
-			url, err := storage.SignedURL(bucket.Name, object, &signedURLOptions)
-			if err != nil {
-				fmt.Println("error %s \n", err)
+
+			upstreamErr, ok := err.(*UpstreamError)
+			if ok && upstreamErr.Status == http.StatusNotFound {
 				continue
 			}
-			res, err = http.Get(url)
-			if err != nil {
-				continue
+			if ok && upstreamErr.Misconfigured() {
+				log.Printf("[ERROR] gcs: access denied to bucket %s, check its credentials: %v", upstreamErr.Bucket, err)
 			}
-			if res.StatusCode != 200 {
-				continue
-			} else {
-				found = true
-				break
+			if firstErr == nil {
+				firstErr = err
 			}
 		}
-		if found {
-			response.WriteHeader(res.StatusCode)
-			response.WaitBody()
-			body, _ := ioutil.ReadAll(res.Body)
-			response.Write(body)
-			response.Close()
+	}
+	return nil, "", nil, firstErr
+}
+
+func (handler *Handler) fetchUpstream(req *http.Request) (*HTTPCacheEntry, error) {
+	t := handler.target(req)
+	_, _, res, err := handler.findObject(req, t, "GET")
+	if err != nil {
+		return nil, err
+	}
+
+	var response *Response
+	if res != nil {
+		response = handler.proxyResponse(req, res, res.StatusCode)
+	} else {
+		location, err := handler.directoryRedirect(req, t)
+		if err != nil {
+			return nil, err
+		}
+
+		if location != "" {
+			response = emptyResponse(http.StatusMovedPermanently, http.Header{"Location": {location}})
+		} else if handler.Config.Fallthrough {
+			response = emptyResponse(http.StatusNotFound, nil)
+		} else if page := handler.findErrorPage(req, t, http.StatusNotFound, "GET"); page != nil {
+			response = handler.proxyResponse(req, page, http.StatusNotFound)
 		} else {
-			response.WriteHeader(404)
+			response = emptyResponse(http.StatusNotFound, nil)
 		}
-		errChan <- fmt.Errorf("not found")
-	}(req, response)
-	// Wait headers to be sent
-	response.WaitHeaders()
+	}
+
 	// Create a new CacheEntry
-	return NewHTTPCacheEntry(getKey(handler.Config.CacheKeyTemplate, req), req, response, handler.Config), popOrNil(errChan)
+	entry := NewHTTPCacheEntry(getKey(handler.Config.CacheKeyTemplate, req), req, response, handler.Config)
+	// The objects bigger than the cache are served like private ones, without storing them
+	if !handler.Cache.fits(entry) {
+		entry.isPublic = false
+	}
+	return entry, nil
+}
+
+// emptyResponse creates a response without body
+func emptyResponse(code int, header http.Header) *Response {
+	response := NewResponse()
+	copyHeaders(header, response.Header())
+	response.WriteHeader(code)
+	go func(response *Response) {
+		response.WaitBody()
+		response.Close()
+	}(response)
+	return response
+}
+
+// proxyResponse creates a response with the status code that streams the upstream response
+func (handler *Handler) proxyResponse(req *http.Request, res *http.Response, code int) *Response {
+	response := NewResponse()
+	copyUpstreamHeaders(res.Header, response.Header(), handler.Config.GoogHeaders)
+	// The whole object is always fetched, Range requests are served from the cache
+	response.Header().Del("Content-Length")
+	if res.ContentLength >= 0 {
+		response.Header().Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	}
+	// The stored body only depends on the Accept-Encoding sent upstream when GCS did not decompress it
+	if res.Header.Get("Content-Encoding") != "" {
+		addVary(response.Header(), "Accept-Encoding")
+	}
+	response.WriteHeader(code)
+	go func(req *http.Request, res *http.Response, response *Response) {
+		defer res.Body.Close()
+		response.WaitBody()
+		if _, err := copyBody(response, res.Body); err != nil {
+			log.Printf("[ERROR] gcs: reading body of %s: %v", req.URL.Path, err)
+			response.Fail()
+		}
+		response.Close()
+	}(req, res, response)
+	return response
 }
 
 func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
@@ -203,6 +344,11 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int,
 	//	extraLabelValues = append(extraLabelValues, replacer.Replace(label.value))
 	//}
 
+	// Writes are only sent to GCS if they are enabled
+	if handler.Config.Write != nil && handler.Config.Write.matches(r) {
+		return handler.serveWrite(w, r)
+	}
+
 	//start := time.Now()
 	if !shouldUseCache(r) {
 		handler.addStatusHeaderIfConfigured(w, cacheBypass)
@@ -210,7 +356,24 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int,
 		return handler.Next.ServeHTTP(w, r)
 	}
 
-	lock := handler.URLLocks.Adquire(getKey(handler.Config.CacheKeyTemplate, r))
+	// HEAD requests never download the body nor create their own entries
+	if r.Method == http.MethodHead {
+		code, cacheStatus, err := handler.serveHead(w, r)
+		responseStatus.WithLabelValues(append([]string{hostname, fam, proto, cacheStatus}, extraLabelValues...)...).Inc()
+		return code, err
+	}
+
+	lock, acquired := handler.URLLocks.Adquire(getKey(handler.Config.CacheKeyTemplate, r), handler.Config.LockTimeout)
+	if !acquired {
+		// Another request is still fetching the object, it may hang
+		// A stale entry is served if there is one, otherwise the object is fetched again
+		lockTimeouts.WithLabelValues(append([]string{hostname, fam, proto}, extraLabelValues...)...).Inc()
+		log.Printf("[WARNING] gcs: timeout waiting for the fetch of %s", r.URL.Path)
+		if stale, ok := handler.Cache.GetStale(r); ok {
+			responseStatus.WithLabelValues(append([]string{hostname, fam, proto, cacheStale}, extraLabelValues...)...).Inc()
+			return handler.serveStale(w, r, stale, warningStale)
+		}
+	}
 
 	// Lookup correct entry
 	previousEntry, exists := handler.Cache.Get(r)
@@ -220,8 +383,36 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int,
 	// It should be served as saved
 	if exists && previousEntry.isPublic {
 		lock.Unlock()
-		responseStatus.WithLabelValues(append([]string{hostname, fam, proto, cacheHit}, extraLabelValues...)...).Inc()
-		return handler.respond(w, previousEntry, cacheHit)
+		cacheStatus := hitStatus(previousEntry)
+		handler.refreshAhead(r, previousEntry)
+		responseStatus.WithLabelValues(append([]string{hostname, fam, proto, cacheStatus}, extraLabelValues...)...).Inc()
+		return handler.respond(w, r, previousEntry, cacheStatus)
+	}
+
+	// Expired entries in their grace window are served while they are fetched again in background
+	if !exists {
+		if stale, ok := handler.Cache.GetStale(r); ok && stale.servableWhileRevalidating() {
+			lock.Unlock()
+			handler.revalidate(r)
+			responseStatus.WithLabelValues(append([]string{hostname, fam, proto, cacheStale}, extraLabelValues...)...).Inc()
+			return handler.serveStale(w, r, stale, warningStale)
+		}
+	}
+
+	// Objects matching the redirect rules are not proxied
+	// The client is sent to GCS with a signed URL
+	if handler.Config.Redirect != nil && handler.Config.Redirect.matches(r) {
+		redirected, code, err := handler.redirect(w, r)
+		if err != nil {
+			lock.Unlock()
+			responseStatus.WithLabelValues(append([]string{hostname, fam, proto, "error"}, extraLabelValues...)...).Inc()
+			return handler.serveError(w, r, code, err)
+		}
+		if redirected {
+			lock.Unlock()
+			responseStatus.WithLabelValues(append([]string{hostname, fam, proto, cacheRedirect}, extraLabelValues...)...).Inc()
+			return code, nil
+		}
 	}
 
 	// Second case: CACHE SKIP
@@ -236,7 +427,7 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int,
 		gcsRequestDuration.WithLabelValues(append([]string{hostname, fam, proto}, extraLabelValues...)...).Observe(time.Since(start).Seconds())
 		if err != nil {
 			responseStatus.WithLabelValues(append([]string{hostname, fam, proto, "error"}, extraLabelValues...)...).Inc()
-			return entry.Response.Code, err
+			return handler.serveError(w, r, upstreamStatus(err), err)
 		}
 
 		// Case when response was private but now is public
@@ -244,15 +435,14 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int,
 			err := entry.setStorage(handler.Config)
 			if err != nil {
 				responseStatus.WithLabelValues(append([]string{hostname, fam, proto, "error"}, extraLabelValues...)...).Inc()
-				fmt.Println("error %s \n", err)
-				return 500, err
+				return handler.serveError(w, r, http.StatusInternalServerError, err)
 			}
 			responseStatus.WithLabelValues(append([]string{hostname, fam, proto, cacheMiss}, extraLabelValues...)...).Inc()
 			handler.Cache.Put(r, entry)
-			return handler.respond(w, entry, cacheMiss)
+			return handler.respond(w, r, entry, cacheMiss)
 		}
 
-		return handler.respond(w, entry, cacheSkip)
+		return handler.respond(w, r, entry, cacheSkip)
 	}
 
 	// Third case: CACHE MISS
@@ -263,8 +453,14 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int,
 	gcsRequestDuration.WithLabelValues(append([]string{hostname, fam, proto}, extraLabelValues...)...).Observe(time.Since(start).Seconds())
 	if err != nil {
 		lock.Unlock()
+		// An expired entry is better than an error
+		if stale, ok := handler.Cache.GetStale(r); ok && stale.servableOnError() {
+			log.Printf("[WARNING] gcs: serving stale %s: %v", r.URL.Path, err)
+			responseStatus.WithLabelValues(append([]string{hostname, fam, proto, cacheStale}, extraLabelValues...)...).Inc()
+			return handler.serveStale(w, r, stale, warningRevalidateFailed)
+		}
 		responseStatus.WithLabelValues(append([]string{hostname, fam, proto, "error"}, extraLabelValues...)...).Inc()
-		return entry.Response.Code, err
+		return handler.serveError(w, r, upstreamStatus(err), err)
 	}
 
 	// Entry is always saved, even if it is not public
@@ -274,15 +470,14 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int,
 		if err != nil {
 			lock.Unlock()
 			responseStatus.WithLabelValues(append([]string{hostname, fam, proto, "error"}, extraLabelValues...)...).Inc()
-			fmt.Println("error %s \n", err)
-			return 500, err
+			return handler.serveError(w, r, http.StatusInternalServerError, err)
 		}
 	}
 
 	handler.Cache.Put(r, entry)
 	lock.Unlock()
 	responseStatus.WithLabelValues(append([]string{hostname, fam, proto, cacheMiss}, extraLabelValues...)...).Inc()
-	return handler.respond(w, entry, cacheMiss)
+	return handler.respond(w, r, entry, cacheMiss)
 }
 func host(r *http.Request) (string, error) {
 	host, _, err := net.SplitHostPort(r.Host)
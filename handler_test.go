@@ -0,0 +1,297 @@
+package gcsproxy
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeGCS is an httptest stand-in of GCS serving path-style URLs /bucket/object
+type fakeGCS struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	objects  map[string]string
+	requests []string
+}
+
+func newFakeGCS(objects map[string]string) *fakeGCS {
+	gcs := &fakeGCS{objects: objects}
+	gcs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gcs.mutex.Lock()
+		gcs.requests = append(gcs.requests, r.Method+" "+r.URL.RequestURI())
+		body, ok := gcs.objects[r.URL.Path]
+		gcs.mutex.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		// Like GCS, the objects stored compressed are only sent compressed to the clients accepting them
+		if strings.HasSuffix(r.URL.Path, ".gz") && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			compressed := gzip.NewWriter(w)
+			compressed.Write([]byte(body))
+			compressed.Close()
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte(body))
+	}))
+	return gcs
+}
+
+// Requests returns the requests received so far
+func (gcs *fakeGCS) Requests() []string {
+	gcs.mutex.Lock()
+	defer gcs.mutex.Unlock()
+	return append([]string(nil), gcs.requests...)
+}
+
+func testPrivateKey(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+// newTestHandler returns a handler with a single bucket served by the fake GCS
+// The cached files are stored in dir
+func newTestHandler(t *testing.T, gcs *fakeGCS, dir string) *Handler {
+	endpoint, err := url.Parse(gcs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := emptyConfig()
+	config.Endpoint = endpoint
+	config.Path = dir
+	config.metrics = NewMetrics()
+	config.metrics.define("")
+	config.Buckets = []Bucket{{
+		Name:        "bucket",
+		Credentials: &googleCloudCredential{GoogleAccessID: "test@example.com", PrivateKey: testPrivateKey(t)},
+		Endpoint:    endpoint,
+	}}
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusTeapot, nil
+	})
+	return NewHandler(next, config)
+}
+
+// newRequest returns a request with the context set by Caddy
+func newRequest(method string, target string, header http.Header) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return req.WithContext(context.WithValue(req.Context(), httpserver.OriginalURLCtxKey, *req.URL))
+}
+
+// serve sends a request through the handler like Caddy does
+func serve(handler *Handler, method string, target string, header http.Header) (*httptest.ResponseRecorder, int, error) {
+	req := newRequest(method, target, header)
+	w := httptest.NewRecorder()
+	code, err := handler.ServeHTTP(w, req)
+	return w, code, err
+}
+
+func TestHandlerEndToEnd(t *testing.T) {
+	gcs := newFakeGCS(map[string]string{"/bucket/dir/hello.txt": "hello world"})
+	defer gcs.Close()
+	dir, remove := tempDir(t)
+	defer remove()
+	handler := newTestHandler(t, gcs, dir)
+
+	for i, status := range []string{"miss", "hit"} {
+		w, code, err := serve(handler, http.MethodGet, "http://example.com/dir/hello.txt", nil)
+		if err != nil || (code != http.StatusOK && code != 0) {
+			t.Fatalf("request %d: status %d error %v", i, code, err)
+		}
+		if w.Body.String() != "hello world" {
+			t.Errorf("request %d: body %q", i, w.Body.String())
+		}
+		if got := w.Header().Get(defaultStatusHeader); got != status {
+			t.Errorf("request %d: cache status %q, want %q", i, got, status)
+		}
+	}
+
+	if got := gcs.Requests(); len(got) != 1 || got[0] != "GET /bucket/dir/hello.txt" {
+		t.Errorf("GCS received %v, want a single unsigned path-style GET", got)
+	}
+}
+
+func TestHandlerVaryAcceptEncoding(t *testing.T) {
+	gcs := newFakeGCS(map[string]string{
+		"/bucket/plain.txt": "plain",
+		"/bucket/styles.gz": "compressed",
+	})
+	defer gcs.Close()
+	dir, remove := tempDir(t)
+	defer remove()
+	handler := newTestHandler(t, gcs, dir)
+
+	tests := []struct {
+		target         string
+		acceptEncoding string
+		status         string
+		vary           string
+		// body is only checked for the identity encoding
+		body string
+	}{
+		// Bodies without Content-Encoding are the same for every client
+		{"http://example.com/plain.txt", "gzip, deflate", "miss", "", "plain"},
+		{"http://example.com/plain.txt", "br", "hit", "", "plain"},
+		{"http://example.com/plain.txt", "", "hit", "", "plain"},
+		{"http://example.com/styles.gz", "gzip", "miss", "Accept-Encoding", ""},
+		{"http://example.com/styles.gz", "gzip", "hit", "Accept-Encoding", ""},
+		// The decompressed body is stored apart, it suits every client
+		{"http://example.com/styles.gz", "", "miss", "", "compressed"},
+		{"http://example.com/styles.gz", "br", "hit", "", "compressed"},
+	}
+	for i, test := range tests {
+		header := http.Header{}
+		if test.acceptEncoding != "" {
+			header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		w, _, err := serve(handler, http.MethodGet, test.target, header)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if got := w.Header().Get(defaultStatusHeader); got != test.status {
+			t.Errorf("request %d: cache status %q, want %q", i, got, test.status)
+		}
+		if got := w.Header().Get("Vary"); got != test.vary {
+			t.Errorf("request %d: Vary %q, want %q", i, got, test.vary)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("request %d: body %q, want %q", i, w.Body.String(), test.body)
+		}
+	}
+}
+
+func TestHandlerEndToEndNotFound(t *testing.T) {
+	gcs := newFakeGCS(map[string]string{})
+	defer gcs.Close()
+	dir, remove := tempDir(t)
+	defer remove()
+	handler := newTestHandler(t, gcs, dir)
+
+	_, code, _ := serve(handler, http.MethodGet, "http://example.com/missing.txt", nil)
+	if code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", code)
+	}
+}
+
+func TestHandlerLockTimeout(t *testing.T) {
+	gcs := newFakeGCS(map[string]string{"/bucket/slow.txt": "fetched again"})
+	defer gcs.Close()
+	dir, remove := tempDir(t)
+	defer remove()
+	handler := newTestHandler(t, gcs, dir)
+	handler.Config.LockTimeout = 50 * time.Millisecond
+
+	// A fetch of the same object that never ends holds the lock
+	key := getKey(handler.Config.CacheKeyTemplate, newRequest(http.MethodGet, "http://example.com/slow.txt", nil))
+	held, acquired := handler.URLLocks.Adquire(key, 0)
+	if !acquired {
+		t.Fatal("the lock was not acquired")
+	}
+	defer held.Unlock()
+
+	lock, acquired := handler.URLLocks.Adquire(key, handler.Config.LockTimeout)
+	if acquired || lock != nil {
+		t.Fatalf("got lock %v acquired %v, want a nil lock after the timeout", lock, acquired)
+	}
+
+	start := time.Now()
+	w, code, err := serve(handler, http.MethodGet, "http://example.com/slow.txt", nil)
+	if err != nil || (code != http.StatusOK && code != 0) {
+		t.Fatalf("status %d error %v", code, err)
+	}
+	if elapsed := time.Since(start); elapsed < handler.Config.LockTimeout {
+		t.Errorf("the request returned after %s, before the lock timeout", elapsed)
+	}
+	if w.Body.String() != "fetched again" {
+		t.Errorf("body %q", w.Body.String())
+	}
+	if got := gcs.Requests(); len(got) != 1 {
+		t.Errorf("GCS received %v, want a single fetch", got)
+	}
+	if got := testutil.ToFloat64(lockTimeouts); got != 1 {
+		t.Errorf("%v lock timeouts counted, want 1", got)
+	}
+}
+
+func TestHandlerErrorPageWithoutStorage(t *testing.T) {
+	gcs := newFakeGCS(map[string]string{
+		"/bucket/hello.txt":  "hello world",
+		"/bucket/error.html": "error page",
+	})
+	defer gcs.Close()
+	dir, remove := tempDir(t)
+	defer remove()
+	// The files can not be created in a regular file
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, gcs, file)
+	handler.Config.ErrorPages["5xx"] = "error.html"
+
+	// Neither the object nor its error page can be stored, Caddy writes the error
+	w, code, err := serve(handler, http.MethodGet, "http://example.com/hello.txt", nil)
+	if code != http.StatusInternalServerError || err == nil || w.Body.Len() != 0 {
+		t.Errorf("status %d error %v body %q, want 500 returned for Caddy to write", code, err, w.Body.String())
+	}
+}
+
+func TestHandlerBiggerThanCache(t *testing.T) {
+	gcs := newFakeGCS(map[string]string{
+		"/bucket/big.txt":   "hello world",
+		"/bucket/small.txt": "hello",
+	})
+	defer gcs.Close()
+	dir, remove := tempDir(t)
+	defer remove()
+	handler := newTestHandler(t, gcs, dir)
+	// The limits are set before the cache is used, like NewHandler does
+	handler.Cache = NewHTTPCache(handler.Config.CacheKeyTemplate)
+	handler.Cache.SetLimits(5, 0, newLRUPolicy())
+
+	for i, test := range []struct{ target, body, status string }{
+		{"http://example.com/small.txt", "hello", "miss"},
+		{"http://example.com/big.txt", "hello world", "miss"},
+		// The big object is fetched every time and the small one is kept
+		{"http://example.com/big.txt", "hello world", "skip"},
+		{"http://example.com/small.txt", "hello", "hit"},
+	} {
+		w, _, err := serve(handler, http.MethodGet, test.target, nil)
+		if err != nil || w.Body.String() != test.body {
+			t.Fatalf("request %d: body %q error %v", i, w.Body.String(), err)
+		}
+		if got := w.Header().Get(defaultStatusHeader); got != test.status {
+			t.Errorf("request %d: cache status %q, want %q", i, got, test.status)
+		}
+	}
+	if got := gcs.Requests(); len(got) != 3 {
+		t.Errorf("GCS received %v, want 3 requests", got)
+	}
+}
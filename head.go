@@ -0,0 +1,103 @@
+package gcsproxy
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// requestWithMethod returns a shallow copy of the request with another method
+// It is used to compute the cache key of the same URL for other methods
+func requestWithMethod(r *http.Request, method string) *http.Request {
+	copied := new(http.Request)
+	*copied = *r
+	copied.Method = method
+	return copied
+}
+
+// serveHead answers HEAD requests from the cached GET entry if there is one
+// Otherwise only the metadata of the object is requested to GCS and nothing is cached
+func (handler *Handler) serveHead(w http.ResponseWriter, r *http.Request) (int, string, error) {
+	getReq := requestWithMethod(r, http.MethodGet)
+	entry, exists := handler.Cache.Get(getReq)
+	if exists && entry.isPublic {
+		cacheStatus := hitStatus(entry)
+		handler.refreshAhead(getReq, entry)
+		code, err := handler.respond(w, r, entry, cacheStatus)
+		return code, cacheStatus, err
+	}
+	var stale *HTTPCacheEntry
+	if !exists {
+		stale, _ = handler.Cache.GetStale(getReq)
+	}
+	if stale != nil && stale.servableWhileRevalidating() {
+		handler.revalidate(getReq)
+		code, err := handler.serveStale(w, r, stale, warningStale)
+		return code, cacheStale, err
+	}
+
+	t := handler.target(r)
+	_, _, res, err := handler.findObject(r, t, http.MethodHead)
+	if err != nil {
+		if stale != nil && stale.servableOnError() {
+			log.Printf("[WARNING] gcs: serving stale %s: %v", r.URL.Path, err)
+			code, err := handler.serveStale(w, r, stale, warningRevalidateFailed)
+			return code, cacheStale, err
+		}
+		code, err := handler.serveError(w, r, upstreamStatus(err), err)
+		return code, "error", err
+	}
+
+	handler.addStatusHeaderIfConfigured(w, cacheMiss)
+	if res == nil {
+		location, err := handler.directoryRedirect(r, t)
+		if err != nil {
+			code, err := handler.serveError(w, r, upstreamStatus(err), err)
+			return code, "error", err
+		}
+		if location != "" {
+			w.Header().Set("Location", location)
+			w.WriteHeader(http.StatusMovedPermanently)
+			return http.StatusMovedPermanently, cacheMiss, nil
+		}
+		if handler.Config.Fallthrough {
+			code, err := handler.Next.ServeHTTP(w, r)
+			return code, cacheMiss, err
+		}
+		if page := handler.findErrorPage(r, t, http.StatusNotFound, http.MethodHead); page != nil {
+			page.Body.Close()
+			copyUpstreamHeaders(page.Header, w.Header(), handler.Config.GoogHeaders)
+			w.Header().Del("Content-Length")
+			if page.ContentLength >= 0 {
+				w.Header().Set("Content-Length", strconv.FormatInt(page.ContentLength, 10))
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return 0, cacheMiss, nil
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return http.StatusNotFound, cacheMiss, nil
+	}
+	res.Body.Close()
+
+	copyUpstreamHeaders(res.Header, w.Header(), handler.Config.GoogHeaders)
+	w.Header().Del("Content-Length")
+	if res.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	}
+	if res.Header.Get("Content-Encoding") != "" {
+		addVary(w.Header(), "Accept-Encoding")
+	}
+
+	switch checkPreconditions(r, w.Header()) {
+	case http.StatusNotModified:
+		writeNotModified(w)
+		return http.StatusNotModified, cacheMiss, nil
+	case http.StatusPreconditionFailed:
+		writePreconditionFailed(w)
+		// The response is already written
+		return 0, cacheMiss, nil
+	}
+
+	w.WriteHeader(res.StatusCode)
+	return res.StatusCode, cacheMiss, nil
+}
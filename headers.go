@@ -0,0 +1,106 @@
+package gcsproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are hop-by-hop headers that must not be forwarded to clients
+// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// upstreamHeaders are set by the GCS frontend and have no meaning for clients
+var upstreamHeaders = []string{
+	"Alt-Svc",
+	"Server",
+	"X-Guploader-Uploadid",
+}
+
+const googHeaderPrefix = "X-Goog-"
+
+// GoogHeaderFilter decides which x-goog-* headers of the objects are sent to the clients
+// Names ending in * match any header with that prefix
+type GoogHeaderFilter struct {
+	Allow bool
+	Names []string
+}
+
+// defaultGoogHeaderFilter does not allow any x-goog-* header
+func defaultGoogHeaderFilter() *GoogHeaderFilter {
+	return &GoogHeaderFilter{Allow: true}
+}
+
+func (f *GoogHeaderFilter) matches(header string) bool {
+	for _, name := range f.Names {
+		name = http.CanonicalHeaderKey(name)
+		if strings.HasSuffix(name, "*") {
+			if strings.HasPrefix(header, strings.TrimSuffix(name, "*")) {
+				return true
+			}
+		} else if header == name {
+			return true
+		}
+	}
+	return false
+}
+
+// permits returns if the header can be sent to the client
+func (f *GoogHeaderFilter) permits(header string) bool {
+	header = http.CanonicalHeaderKey(header)
+	if !strings.HasPrefix(header, googHeaderPrefix) {
+		return true
+	}
+	return f.matches(header) == f.Allow
+}
+
+// copyUpstreamHeaders copies the headers of the object into the response
+// removing hop-by-hop headers and the filtered x-goog-* headers
+func copyUpstreamHeaders(from http.Header, to http.Header, filter *GoogHeaderFilter) {
+	removed := map[string]bool{}
+	for _, h := range hopHeaders {
+		removed[h] = true
+	}
+	for _, h := range upstreamHeaders {
+		removed[h] = true
+	}
+	// Headers listed in Connection are hop-by-hop too
+	for _, value := range from["Connection"] {
+		for _, h := range strings.Split(value, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				removed[http.CanonicalHeaderKey(h)] = true
+			}
+		}
+	}
+
+	for k, values := range from {
+		if removed[k] || !filter.permits(k) {
+			continue
+		}
+		for _, v := range values {
+			to.Add(k, v)
+		}
+	}
+}
+
+// addVary appends the header to the Vary list if it is not already there
+func addVary(header http.Header, name string) {
+	for _, value := range header["Vary"] {
+		for _, h := range strings.Split(value, ",") {
+			h = strings.TrimSpace(h)
+			if h == "*" || strings.EqualFold(h, name) {
+				return
+			}
+		}
+	}
+	header.Set("Vary", strings.Join(append(header["Vary"], name), ", "))
+}
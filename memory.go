@@ -0,0 +1,54 @@
+package gcsproxy
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/Menta2L/caddy-gcsproxy/storage"
+)
+
+// memoryBudget places the small bodies in memory while they fit in the budget
+// The bodies of unknown size are always stored in files
+type memoryBudget struct {
+	threshold int64
+	limit     int64
+	used      int64
+}
+
+// newMemoryBudget returns nil if the bodies are never stored in memory
+func newMemoryBudget(threshold int64, limit int64) *memoryBudget {
+	if threshold <= 0 || limit <= 0 {
+		return nil
+	}
+	return &memoryBudget{threshold: threshold, limit: limit}
+}
+
+// reserve takes size bytes from the budget, it returns false if they do not fit
+func (b *memoryBudget) reserve(size int64) bool {
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if used+size > b.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+size) {
+			return true
+		}
+	}
+}
+
+func (b *memoryBudget) release(size int64) {
+	atomic.AddInt64(&b.used, -size)
+}
+
+// storage returns a memory storage for the body of the entry or nil if it must be stored in a file
+// The budget is released when the storage is cleaned
+func (b *memoryBudget) storage(e *HTTPCacheEntry) storage.ResponseStorage {
+	if b == nil {
+		return nil
+	}
+	size, err := strconv.ParseInt(e.Response.snapHeader.Get("Content-Length"), 10, 64)
+	if err != nil || size < 0 || size > b.threshold || !b.reserve(size) {
+		return nil
+	}
+	return storage.NewMemoryStorage(size, func() { b.release(size) })
+}
@@ -20,6 +20,8 @@ var (
 	responseSize       *prometheus.HistogramVec
 	responseStatus     *prometheus.CounterVec
 	responseLatency    *prometheus.HistogramVec
+	lockTimeouts       *prometheus.CounterVec
+	evictions          *prometheus.CounterVec
 )
 
 // Metrics holds the prometheus configuration.
@@ -41,7 +43,7 @@ type extraLabel struct {
 	value string
 }
 
-func (m Metrics) define(subsystem string) {
+func (m *Metrics) define(subsystem string) {
 	if subsystem == "" {
 		subsystem = "http"
 	}
@@ -85,6 +87,20 @@ func (m Metrics) define(subsystem string) {
 		Help:      "Histogram of the time (in seconds) until the first write for each request.",
 		Buckets:   append(prometheus.DefBuckets, 15, 20, 30, 60, 120, 180, 240, 480, 960),
 	}, append([]string{"host", "family", "proto", "status"}, extraLabels...))
+
+	lockTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "lock_timeout_count_total",
+		Help:      "Counter of requests that stopped waiting for the fetch of the same object.",
+	}, append([]string{"host", "family", "proto"}, extraLabels...))
+
+	evictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "cache_eviction_count_total",
+		Help:      "Counter of entries evicted because the cache was full.",
+	}, []string{"policy"})
 }
 func (m *Metrics) extraLabelNames() []string {
 	names := make([]string, 0, len(m.extraLabels))
@@ -105,6 +121,8 @@ func (m *Metrics) start() error {
 		prometheus.MustRegister(responseLatency)
 		prometheus.MustRegister(responseSize)
 		prometheus.MustRegister(responseStatus)
+		prometheus.MustRegister(lockTimeouts)
+		prometheus.MustRegister(evictions)
 
 		if !m.useCaddyAddr {
 			http.Handle(m.path, m.handler)
@@ -0,0 +1,286 @@
+package gcsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Menta2L/caddy-gcsproxy/storage"
+)
+
+const (
+	// bodyFilePrefix is the prefix of the files created by storage.NewFileStorage
+	bodyFilePrefix = "caddy-cache-"
+	// recordSuffix is appended to the name of the body to name its metadata record
+	recordSuffix = ".meta"
+	// tempSuffix marks the records that are being written
+	tempSuffix = ".tmp"
+)
+
+// cacheRecord is the metadata of a cached entry, stored next to its body
+// It has everything needed to rebuild the entry when the process restarts
+type cacheRecord struct {
+	Key                  string        `json:"key"`
+	Status               int           `json:"status"`
+	Header               http.Header   `json:"header"`
+	Expiration           time.Time     `json:"expiration"`
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate"`
+	StaleIfError         time.Duration `json:"stale_if_error"`
+	// Vary are the request headers named by the Vary header of the response
+	Vary http.Header `json:"vary"`
+	// Size and Checksum are the length and the SHA-256 of the body
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// restoredPaths are the directories already restored by this process
+// The entries of a directory are only restored once, after a reload they belong to the previous handler
+var restoredPaths = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+func newCacheRecord(entry *HTTPCacheEntry, body *storage.FileStorage) *cacheRecord {
+	vary := http.Header{}
+	for _, values := range entry.Response.HeaderMap["Vary"] {
+		for _, name := range strings.Split(values, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			for _, value := range entry.Request.Header[http.CanonicalHeaderKey(name)] {
+				vary.Add(name, value)
+			}
+		}
+	}
+
+	return &cacheRecord{
+		Key:                  entry.key,
+		Status:               entry.Response.Code,
+		Header:               entry.Response.snapHeader,
+		Expiration:           entry.expiration,
+		StaleWhileRevalidate: entry.staleWhileRevalidate,
+		StaleIfError:         entry.staleIfError,
+		Vary:                 vary,
+		Size:                 atomic.LoadInt64(&entry.Response.written),
+		Checksum:             body.Checksum(),
+	}
+}
+
+// writeRecord saves the record atomically, a crash never leaves half a record
+func writeRecord(path string, record *cacheRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+tempSuffix, content, 0600); err != nil {
+		os.Remove(path + tempSuffix)
+		return err
+	}
+	return os.Rename(path+tempSuffix, path)
+}
+
+// readRecord loads the record of the body and checks its size
+// The checksum is verified later, reading every body would delay the startup
+func readRecord(path string, size int64) (*cacheRecord, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	record := &cacheRecord{}
+	if err := json.Unmarshal(content, record); err != nil {
+		return nil, err
+	}
+	if record.Key == "" || record.Status == 0 {
+		return nil, fmt.Errorf("incomplete record")
+	}
+	if size != record.Size {
+		return nil, fmt.Errorf("the body has %d bytes instead of %d", size, record.Size)
+	}
+	return record, nil
+}
+
+// restore stores the restored entries whose body matches the checksum of their record
+// It runs in background after the startup, corrupt entries are never served
+// The entries fetched meanwhile are newer, they are kept instead of the restored ones
+func (cache *HTTPCache) restore(entries []*HTTPCacheEntry, checksums []string) {
+	for i, entry := range entries {
+		body := entry.Response.body.(*storage.FileStorage)
+		checksum, _, err := storage.FileChecksum(body.Name())
+		if err == nil && checksum != checksums[i] {
+			err = fmt.Errorf("the body does not match its checksum")
+		}
+		if err != nil {
+			log.Printf("[WARNING] gcs: discarding cached file %s: %v", body.Name(), err)
+			entry.Clean()
+			continue
+		}
+		if !cache.put(entry, false) {
+			entry.Clean()
+		}
+	}
+	cache.evict()
+}
+
+// saveRecord writes the record of the entry unless it was already cleaned
+func (e *HTTPCacheEntry) saveRecord(path string, record *cacheRecord) error {
+	e.recordLock.Lock()
+	defer e.recordLock.Unlock()
+	if e.cleaned {
+		return nil
+	}
+	if err := writeRecord(path, record); err != nil {
+		return err
+	}
+	e.record = path
+	return nil
+}
+
+// removeRecord deletes the record so the entry is not restored anymore
+func (e *HTTPCacheEntry) removeRecord() {
+	e.recordLock.Lock()
+	defer e.recordLock.Unlock()
+	e.cleaned = true
+	if e.record != "" {
+		os.Remove(e.record)
+		e.record = ""
+	}
+}
+
+// persist writes the record of the entry once its body is completely stored
+// Only the bodies stored in files are persisted, incomplete bodies are never restored
+func (cache *HTTPCache) persist(entry *HTTPCacheEntry) {
+	if cache.path == "" || !entry.isPublic {
+		return
+	}
+	go func() {
+		entry.Response.WaitClose()
+		body, ok := entry.Response.body.(*storage.FileStorage)
+		if !ok || entry.Response.Failed() {
+			return
+		}
+		if err := entry.saveRecord(body.Name()+recordSuffix, newCacheRecord(entry, body)); err != nil {
+			log.Printf("[ERROR] gcs: saving the record of %s: %v", entry.key, err)
+		}
+	}()
+}
+
+// Restore stores the records of the new entries in path and loads the entries saved there by a previous process
+// Corrupt and expired records are removed with their bodies, and so are the bodies without record
+// The entries are only cached once the checksums of their bodies are verified in background
+// It returns the number of entries being restored
+func (cache *HTTPCache) Restore(path string) (int, error) {
+	cache.path = path
+
+	restoredPaths.Lock()
+	restored := restoredPaths.paths[path]
+	restoredPaths.paths[path] = true
+	restoredPaths.Unlock()
+	if restored {
+		return 0, nil
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		names[file.Name()] = true
+	}
+
+	var entries []*HTTPCacheEntry
+	var checksums []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, bodyFilePrefix) {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, tempSuffix):
+			os.Remove(filepath.Join(path, name))
+			continue
+		case strings.HasSuffix(name, recordSuffix):
+			// Records without body
+			if !names[strings.TrimSuffix(name, recordSuffix)] {
+				os.Remove(filepath.Join(path, name))
+			}
+			continue
+		}
+
+		body := filepath.Join(path, name)
+		if !names[name+recordSuffix] {
+			// The process stopped before the body was complete
+			os.Remove(body)
+			continue
+		}
+		entry, record, err := restoreEntry(body, body+recordSuffix, file.Size())
+		if err == nil && !cache.fits(entry) {
+			log.Printf("[WARNING] gcs: discarding cached file %s: bigger than the maximum size of the cache", body)
+			entry.Clean()
+			continue
+		}
+		if err != nil {
+			log.Printf("[WARNING] gcs: discarding cached file %s: %v", body, err)
+			os.Remove(body + recordSuffix)
+			os.Remove(body)
+			continue
+		}
+		entries = append(entries, entry)
+		checksums = append(checksums, record.Checksum)
+	}
+	go cache.restore(entries, checksums)
+	return len(entries), nil
+}
+
+// restoreEntry rebuilds the entry of a body and its record
+func restoreEntry(body string, path string, size int64) (*HTTPCacheEntry, *cacheRecord, error) {
+	record, err := readRecord(path, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry := &HTTPCacheEntry{
+		isPublic:             true,
+		expiration:           record.Expiration,
+		key:                  record.Key,
+		staleWhileRevalidate: record.StaleWhileRevalidate,
+		staleIfError:         record.StaleIfError,
+		record:               path,
+	}
+	if !entry.graceEnd().After(time.Now()) {
+		return nil, nil, fmt.Errorf("expired at %s", record.Expiration)
+	}
+
+	fileStorage, err := storage.OpenFileStorage(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	response := NewResponse()
+	copyHeaders(record.Header, response.HeaderMap)
+	response.WriteHeader(record.Status)
+	response.SetBody(fileStorage)
+	response.written = record.Size
+	response.Close()
+
+	vary := record.Vary
+	if vary == nil {
+		vary = http.Header{}
+	}
+	entry.Request = &http.Request{Method: http.MethodGet, URL: &url.URL{}, Header: vary}
+	entry.Response = response
+	return entry, record, nil
+}
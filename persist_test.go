@@ -0,0 +1,67 @@
+package gcsproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCachedFile writes a body and its record like a previous process would
+func writeCachedFile(t *testing.T, dir string, name string, key string, body string, checksumOf string) string {
+	path := filepath.Join(dir, bodyFilePrefix+name)
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checksum := sha256.Sum256([]byte(checksumOf))
+	record := &cacheRecord{
+		Key:        key,
+		Status:     http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Expiration: time.Now().Add(time.Hour),
+		Size:       int64(len(body)),
+		Checksum:   hex.EncodeToString(checksum[:]),
+	}
+	if err := writeRecord(path+recordSuffix, record); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRestoreDiscardsCorruptBodies(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	writeCachedFile(t, dir, "valid", "/valid", "hello", "hello")
+	// Same size, so only the checksum tells it apart
+	corrupt := writeCachedFile(t, dir, "corrupt", "/corrupt", "HELLO", "hello")
+
+	cache := NewHTTPCache("{path}")
+	restoring, err := cache.Restore(dir)
+	if err != nil || restoring != 2 {
+		t.Fatalf("restoring %d entries error %v", restoring, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := cache.Get(newRequest(http.MethodGet, "http://example.com/corrupt", nil)); ok {
+			t.Fatal("the corrupt entry was served")
+		}
+		if _, ok := cache.Get(newRequest(http.MethodGet, "http://example.com/valid", nil)); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the valid entry was not restored")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, path := range []string{corrupt, corrupt + recordSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", path, err)
+		}
+	}
+}
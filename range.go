@@ -0,0 +1,220 @@
+package gcsproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// errNoOverlap is returned by parseRange if none of the ranges overlap
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// httpRange specifies the byte range to be sent to the client.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// parseRange parses a Range header string as per RFC 7233.
+// errNoOverlap is returned if none of the ranges overlap.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil // header not present
+	}
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, errors.New("invalid range")
+		}
+		start, end := textproto.TrimString(ra[:i]), textproto.TrimString(ra[i+1:])
+		var r httpRange
+		if start == "" {
+			// If no start is specified, end specifies the
+			// range start relative to the end of the object.
+			if end == "" || end[0] == '-' {
+				return nil, errors.New("invalid range")
+			}
+			i, err := strconv.ParseInt(end, 10, 64)
+			if i < 0 || err != nil {
+				return nil, errors.New("invalid range")
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i >= size {
+				// If the range begins after the size of the content,
+				// then it does not overlap.
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				// If no end is specified, range extends to end of the object.
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+func sumRangesSize(ranges []httpRange) (size int64) {
+	for _, ra := range ranges {
+		size += ra.length
+	}
+	return
+}
+
+// checkIfRange returns true if the Range header should be honored
+// for the given entry according to the If-Range header of the request
+func checkIfRange(req *http.Request, header http.Header) bool {
+	ir := req.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+
+	if etag, _ := scanETag(ir); etag != "" {
+		return etagStrongMatch(etag, header.Get("Etag"))
+	}
+
+	// The If-Range value may also be the Last-Modified date
+	modtime, ok := lastModified(header)
+	if !ok {
+		return false
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	return t.Equal(modtime)
+}
+
+// rangeRequestable checks if the entry can be used to serve a Range request.
+// Only complete public responses with a known size can be served partially.
+func rangeRequestable(entry *HTTPCacheEntry) (int64, bool) {
+	if !entry.isPublic || entry.Response.Code != http.StatusOK {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(entry.Response.snapHeader.Get("Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+
+	return size, true
+}
+
+// respondRange writes a 206 or 416 response for the given ranges
+func (handler *Handler) respondRange(w http.ResponseWriter, req *http.Request, entry *HTTPCacheEntry, size int64) (int, error) {
+	ranges, err := parseRange(req.Header.Get("Range"), size)
+	if err != nil {
+		if err == errNoOverlap {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		// The response is already written
+		return 0, nil
+	}
+
+	// If the sum of the ranges is bigger than the object, serve the whole object
+	if len(ranges) == 0 || sumRangesSize(ranges) > size {
+		w.WriteHeader(entry.Response.Code)
+		if req.Method == http.MethodHead {
+			return entry.Response.Code, nil
+		}
+		return entry.Response.Code, entry.WriteBodyTo(w)
+	}
+
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		w.Header().Set("Content-Range", ra.contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if req.Method == http.MethodHead {
+			return http.StatusPartialContent, nil
+		}
+		return http.StatusPartialContent, entry.WriteRangeTo(w, ra.start, ra.length)
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusPartialContent)
+	if req.Method == http.MethodHead {
+		return http.StatusPartialContent, nil
+	}
+
+	for _, ra := range ranges {
+		part, err := mw.CreatePart(ra.mimeHeader(contentType, size))
+		if err != nil {
+			return http.StatusPartialContent, err
+		}
+		if err := entry.WriteRangeTo(part, ra.start, ra.length); err != nil {
+			return http.StatusPartialContent, err
+		}
+	}
+
+	return http.StatusPartialContent, mw.Close()
+}
+
+// copyRange copies length bytes starting at offset from the reader
+// into the writer. Seekable readers are moved directly to the offset.
+func copyRange(w io.Writer, reader io.Reader, offset, length int64) error {
+	if seeker, ok := reader.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	} else if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(w, reader, length)
+	return err
+}
@@ -0,0 +1,203 @@
+package gcsproxy
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Menta2L/caddy-gcsproxy/storage"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   []httpRange
+		err    bool
+	}{
+		{"", 10, nil, false},
+		{"bytes=0-4", 10, []httpRange{{0, 5}}, false},
+		{"bytes=2-", 10, []httpRange{{2, 8}}, false},
+		{"bytes=5-100", 10, []httpRange{{5, 5}}, false},
+		// Suffix ranges are the last bytes of the object
+		{"bytes=-3", 10, []httpRange{{7, 3}}, false},
+		{"bytes=-20", 10, []httpRange{{0, 10}}, false},
+		{"bytes=-0", 10, []httpRange{{10, 0}}, false},
+		{"bytes=0-1, 4-5,-2", 10, []httpRange{{0, 2}, {4, 2}, {8, 2}}, false},
+		// The ranges after the end are ignored while another one overlaps
+		{"bytes=20-30,0-0", 10, []httpRange{{0, 1}}, false},
+		{"bytes=0-0,,", 10, []httpRange{{0, 1}}, false},
+		{"bytes=10-", 10, nil, true},
+		{"bytes=20-30", 10, nil, true},
+		{"items=0-4", 10, nil, true},
+		{"bytes=4-2", 10, nil, true},
+		{"bytes=a-b", 10, nil, true},
+		{"bytes=--3", 10, nil, true},
+		{"bytes=-", 10, nil, true},
+		{"bytes=5", 10, nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseRange(test.header, test.size)
+		if (err != nil) != test.err {
+			t.Errorf("parseRange(%q, %d) error %v, want error %v", test.header, test.size, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseRange(%q, %d) = %v, want %v", test.header, test.size, got, test.want)
+		}
+	}
+
+	if _, err := parseRange("bytes=10-", 10); err != errNoOverlap {
+		t.Errorf("a range after the end returned %v instead of errNoOverlap", err)
+	}
+	if _, err := parseRange("bytes=4-2", 10); err == errNoOverlap {
+		t.Errorf("an invalid range returned errNoOverlap")
+	}
+}
+
+func TestCheckIfRange(t *testing.T) {
+	header := http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"},
+	}
+	tests := []struct {
+		ifRange string
+		want    bool
+	}{
+		{"", true},
+		{`"v1"`, true},
+		{`"v2"`, false},
+		// If-Range requires a strong comparison
+		{`W/"v1"`, false},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", true},
+		{"Mon, 02 Jan 2006 15:04:06 GMT", false},
+		{"not a date", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.ifRange != "" {
+			req.Header.Set("If-Range", test.ifRange)
+		}
+		if got := checkIfRange(req, header); got != test.want {
+			t.Errorf("If-Range %q = %v, want %v", test.ifRange, got, test.want)
+		}
+	}
+}
+
+// newBodyEntry returns a complete public entry with the body stored in a file of dir
+func newBodyEntry(t *testing.T, dir string, body string) *HTTPCacheEntry {
+	fileStorage, err := storage.NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := NewResponse()
+	response.Header().Set("Content-Type", "text/plain")
+	response.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	response.WriteHeader(http.StatusOK)
+	response.SetBody(fileStorage)
+	response.Write([]byte(body))
+	response.Close()
+	return &HTTPCacheEntry{isPublic: true, Response: response}
+}
+
+// tempDir returns a new temporary directory and the function removing it
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gcsproxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestRespondRange(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	const body = "0123456789"
+	tests := []struct {
+		name         string
+		method       string
+		rangeHeader  string
+		code         int
+		contentRange string
+		body         string
+	}{
+		{"single", http.MethodGet, "bytes=2-4", http.StatusPartialContent, "bytes 2-4/10", "234"},
+		{"suffix", http.MethodGet, "bytes=-3", http.StatusPartialContent, "bytes 7-9/10", "789"},
+		{"open end", http.MethodGet, "bytes=8-", http.StatusPartialContent, "bytes 8-9/10", "89"},
+		{"head", http.MethodHead, "bytes=2-4", http.StatusPartialContent, "bytes 2-4/10", ""},
+		{"no overlap", http.MethodGet, "bytes=10-20", http.StatusRequestedRangeNotSatisfiable, "bytes */10", ""},
+		{"invalid", http.MethodGet, "bytes=4-2", http.StatusRequestedRangeNotSatisfiable, "", ""},
+		// Ranges bigger than the object together are answered with the whole object
+		{"overlapping ranges fallback", http.MethodGet, "bytes=0-7,2-9", http.StatusOK, "", body},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/", nil)
+			req.Header.Set("Range", test.rangeHeader)
+			w := httptest.NewRecorder()
+			code, err := (&Handler{}).respondRange(w, req, newBodyEntry(t, dir, body), int64(len(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != test.code {
+				t.Errorf("status %d written, want %d", w.Code, test.code)
+			}
+			// Caddy writes its own page for the errors returned, they must not be returned once written
+			if code >= 400 {
+				t.Errorf("status %d returned after writing the response", code)
+			}
+			if got := w.Header().Get("Content-Range"); got != test.contentRange {
+				t.Errorf("Content-Range %q, want %q", got, test.contentRange)
+			}
+			if got := w.Body.String(); got != test.body {
+				t.Errorf("body %q, want %q", got, test.body)
+			}
+		})
+	}
+}
+
+func TestRespondMultipleRanges(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", "bytes=0-1,-2")
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/plain")
+	code, err := (&Handler{}).respondRange(w, req, newBodyEntry(t, dir, "0123456789"), 10)
+	if err != nil || code != http.StatusPartialContent {
+		t.Fatalf("status %d error %v", code, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type %q", w.Header().Get("Content-Type"))
+	}
+	reader := multipart.NewReader(strings.NewReader(w.Body.String()), params["boundary"])
+	want := []struct{ contentRange, body string }{
+		{"bytes 0-1/10", "01"},
+		{"bytes 8-9/10", "89"},
+	}
+	for _, expected := range want {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(part)
+		if part.Header.Get("Content-Range") != expected.contentRange || string(content) != expected.body {
+			t.Errorf("part %q %q, want %q %q", part.Header.Get("Content-Range"), content, expected.contentRange, expected.body)
+		}
+		if part.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("part Content-Type %q", part.Header.Get("Content-Type"))
+		}
+	}
+	if _, err := reader.NextPart(); err == nil {
+		t.Errorf("unexpected extra part")
+	}
+}
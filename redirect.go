@@ -0,0 +1,70 @@
+package gcsproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+var defaultRedirectStatus = http.StatusFound
+
+// RedirectConfig sends the clients directly to GCS with a signed URL
+// instead of proxying the objects. Objects smaller than MinSize
+// or outside Paths are still proxied and cached
+type RedirectConfig struct {
+	Status int
+	// MinSize is the minimum size in bytes of the redirected objects, 0 redirects any size
+	MinSize int64
+	// Paths limits the redirects to the requests starting with any of them
+	Paths []string
+}
+
+func defaultRedirectConfig() *RedirectConfig {
+	return &RedirectConfig{
+		Status: defaultRedirectStatus,
+	}
+}
+
+func (r *RedirectConfig) matches(req *http.Request) bool {
+	if len(r.Paths) == 0 {
+		return true
+	}
+	for _, path := range r.Paths {
+		if strings.HasPrefix(req.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirect answers with a redirect to a signed URL of the bucket that has the object.
+// It returns false if the object should be proxied instead
+func (handler *Handler) redirect(w http.ResponseWriter, r *http.Request) (bool, int, error) {
+	config := handler.Config.Redirect
+
+	// Only the metadata is needed to find the bucket and the size
+	bucket, object, res, err := handler.findObject(r, handler.target(r), http.MethodHead)
+	if err != nil {
+		return false, upstreamStatus(err), err
+	}
+	if res == nil {
+		// Let the proxy answer the missing object
+		return false, 0, nil
+	}
+	res.Body.Close()
+
+	if config.MinSize > 0 && (res.ContentLength < 0 || res.ContentLength < config.MinSize) {
+		return false, 0, nil
+	}
+
+	url, err := bucket.signedURL(object, r.Method)
+	if err != nil {
+		return false, http.StatusInternalServerError, bucket.signingError(object, err)
+	}
+
+	handler.addStatusHeaderIfConfigured(w, cacheRedirect)
+	// The signed URL expires, the redirect must not be stored
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Location", url)
+	w.WriteHeader(config.Status)
+	return true, config.Status, nil
+}
@@ -0,0 +1,39 @@
+package gcsproxy
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RefreshAheadConfig refreshes in background the entries that are hit close to their expiration
+// so hot objects are never missed
+type RefreshAheadConfig struct {
+	// Window is the time before the expiration when a hit refreshes the entry
+	Window time.Duration
+	// Probabilistic spreads the refreshes over the window,
+	// a hit is more likely to refresh the entry the closer it is to the expiration
+	Probabilistic bool
+}
+
+// shouldRefresh returns if a hit on the entry must refresh it
+func (config *RefreshAheadConfig) shouldRefresh(entry *HTTPCacheEntry) bool {
+	remaining := entry.expiration.Sub(time.Now())
+	if remaining <= 0 || remaining > config.Window {
+		return false
+	}
+	if !config.Probabilistic {
+		return true
+	}
+	return rand.Float64() >= float64(remaining)/float64(config.Window)
+}
+
+// refreshAhead starts the refresh of the entry if it is about to expire
+// The new entry replaces it when it is fetched, only one refresh runs for each key
+func (handler *Handler) refreshAhead(r *http.Request, entry *HTTPCacheEntry) {
+	config := handler.Config.RefreshAhead
+	if config == nil || !config.shouldRefresh(entry) {
+		return
+	}
+	handler.revalidate(r)
+}
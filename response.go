@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/Menta2L/caddy-gcsproxy/storage"
 )
@@ -16,6 +17,9 @@ type Response struct {
 
 	wroteHeader   bool
 	firstByteSent bool
+	failed        int32
+	// written counts the bytes of the body
+	written int64
 
 	bodyLock    *sync.RWMutex
 	closedLock  *sync.RWMutex
@@ -94,7 +98,9 @@ func (rw *Response) Write(buf []byte) (int, error) {
 	}
 
 	if rw.body != nil {
-		return rw.body.Write(buf)
+		n, err := rw.body.Write(buf)
+		atomic.AddInt64(&rw.written, int64(n))
+		return n, err
 	}
 
 	return 0, errors.New("No storage")
@@ -145,6 +151,17 @@ func (rw *Response) Flush() {
 	return
 }
 
+// Fail marks the response as incomplete
+// It should be called before Close if the body could not be fully written
+func (rw *Response) Fail() {
+	atomic.StoreInt32(&rw.failed, 1)
+}
+
+// Failed returns if the body of the response is incomplete
+func (rw *Response) Failed() bool {
+	return atomic.LoadInt32(&rw.failed) == 1
+}
+
 // Close means there won't be any more Writes
 // It closes body if it was set before
 // It should be called after SetBody using WaitBody()
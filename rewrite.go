@@ -0,0 +1,71 @@
+package gcsproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// RewriteConfig maps the object name of a request to the layout of the bucket
+// The rewrites are applied in order: strip the prefix, add the prefix, add the index document
+type RewriteConfig struct {
+	// StripPrefix is removed from the start of the object name, like a mount point
+	StripPrefix string
+	// AddPrefix is the folder of the bucket where the objects are
+	AddPrefix string
+	// IndexDocument is appended to the names ending with /, like GCS website configuration
+	IndexDocument string
+}
+
+// apply rewrites the object name
+func (rewrite *RewriteConfig) apply(object string) string {
+	if rewrite == nil {
+		return object
+	}
+	if rewrite.StripPrefix != "" && strings.HasPrefix(object, rewrite.StripPrefix) {
+		rest := object[len(rewrite.StripPrefix):]
+		// Only whole path segments are stripped
+		if rest == "" || strings.HasPrefix(rest, "/") || strings.HasSuffix(rewrite.StripPrefix, "/") {
+			object = strings.TrimLeft(rest, "/")
+		}
+	}
+	if rewrite.AddPrefix != "" {
+		object = rewrite.AddPrefix + "/" + object
+	}
+	if rewrite.IndexDocument != "" && (object == "" || strings.HasSuffix(object, "/")) {
+		object += rewrite.IndexDocument
+	}
+	return object
+}
+
+// directoryRedirect returns the URL with a trailing slash if the request
+// has no trailing slash and the index document of that directory exists
+// An empty location means there is nothing to redirect to
+func (handler *Handler) directoryRedirect(req *http.Request, t *target) (string, error) {
+	rewrite := handler.Config.Rewrite
+	if rewrite == nil || rewrite.IndexDocument == "" || t.object == "" || strings.HasSuffix(req.URL.Path, "/") {
+		return "", nil
+	}
+
+	object := t.object + "/" + rewrite.IndexDocument
+	index := &target{
+		buckets:    t.buckets,
+		object:     object,
+		candidates: []string{object},
+	}
+	_, _, res, err := handler.findObject(req, index, http.MethodHead)
+	if err != nil || res == nil {
+		return "", err
+	}
+	res.Body.Close()
+
+	// The client must be redirected to the URL it requested, not the rewritten one
+	location := *req.URL
+	if original, ok := req.Context().Value(httpserver.OriginalURLCtxKey).(url.URL); ok {
+		location = original
+	}
+	redirect := &url.URL{Path: location.Path + "/", RawQuery: location.RawQuery}
+	return redirect.String(), nil
+}
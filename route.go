@@ -0,0 +1,131 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// defaultObjectTemplate maps the request path to the object name
+const defaultObjectTemplate = "{object}"
+
+// Route sends the requests matching Host and PathPrefix to its own buckets
+//
+// Host may contain a single * that matches part of a label,
+// like *.example.com or preview-*.example.com. "*" matches every host.
+// The object name is built replacing in ObjectTemplate the Caddy placeholders and:
+//
+//	{wildcard} the text matched by * in Host
+//	{object}   the request path without PathPrefix and the leading slash
+type Route struct {
+	Host           string
+	PathPrefix     string
+	BucketNames    []string
+	ObjectTemplate string
+
+	buckets []*Bucket
+}
+
+// target is where the object of a request is looked up
+type target struct {
+	buckets []*Bucket
+	// name is the object name of the request before the rewrites
+	name string
+	// object is the object of the request, writes and redirects use it
+	object string
+	// candidates are the objects looked up in order to answer reads
+	candidates []string
+}
+
+// matchHost returns if the host matches the pattern and the text matched by *
+func matchHost(pattern string, host string) (string, bool) {
+	if pattern == "*" {
+		return host, true
+	}
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return "", pattern == host
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(host) <= len(prefix)+len(suffix) || !strings.HasPrefix(host, prefix) || !strings.HasSuffix(host, suffix) {
+		return "", false
+	}
+	wildcard := host[len(prefix) : len(host)-len(suffix)]
+	// The wildcard matches a part of a single label
+	if strings.Contains(wildcard, ".") {
+		return "", false
+	}
+	return wildcard, true
+}
+
+// matches returns if the route serves the request and the text matched by the host wildcard
+func (route *Route) matches(req *http.Request) (string, bool) {
+	if !strings.HasPrefix(req.URL.Path, route.PathPrefix) {
+		return "", false
+	}
+	hostname, err := host(req)
+	if err != nil {
+		return "", false
+	}
+	return matchHost(route.Host, hostname)
+}
+
+// resolveBuckets links the route with the buckets of the configuration
+func (route *Route) resolveBuckets(buckets []Bucket) error {
+	route.buckets = nil
+	for _, name := range route.BucketNames {
+		var found *Bucket
+		for i := range buckets {
+			if buckets[i].Name == name {
+				found = &buckets[i]
+				break
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("route %s%s: bucket %s is not defined", route.Host, route.PathPrefix, name)
+		}
+		route.buckets = append(route.buckets, found)
+	}
+	return nil
+}
+
+// objectName builds the name of the object for the request
+func objectName(req *http.Request, template string, pathPrefix string, wildcard string) string {
+	object := strings.TrimLeft(strings.TrimPrefix(req.URL.Path, pathPrefix), "/")
+	if template == defaultObjectTemplate {
+		return object
+	}
+	replacer := httpserver.NewReplacer(req, nil, "")
+	replacer.Set("wildcard", wildcard)
+	replacer.Set("object", object)
+	return strings.TrimLeft(replacer.Replace(template), "/")
+}
+
+// target returns the buckets and the object for the request
+// Routes are checked in order, requests without route use every bucket
+// The rewrites of the block are applied to the object of any route
+func (handler *Handler) target(req *http.Request) *target {
+	t := &target{}
+	name := ""
+	for _, route := range handler.Config.Routes {
+		if wildcard, ok := route.matches(req); ok {
+			t.buckets = route.buckets
+			name = objectName(req, route.ObjectTemplate, route.PathPrefix, wildcard)
+			break
+		}
+	}
+	if t.buckets == nil {
+		t.buckets = make([]*Bucket, len(handler.Config.Buckets))
+		for i := range handler.Config.Buckets {
+			t.buckets[i] = &handler.Config.Buckets[i]
+		}
+		name = strings.TrimLeft(req.URL.Path, "/")
+	}
+
+	t.name = name
+	t.object = handler.Config.Rewrite.apply(name)
+	t.candidates = tryFiles(handler.Config.TryFiles, handler.Config.Rewrite, name)
+	return t
+}
@@ -44,11 +44,20 @@ func (rule *HeaderCacheRule) matches(req *http.Request, statusCode int, respHead
 }
 
 func getCacheableStatus(req *http.Request, response *Response, config *Config) (bool, time.Time) {
-	// Partial responses are not supported yet
+	// Partial responses are never stored, the whole object is fetched
+	// and Range requests are answered from the cached entry
 	if response.Code == http.StatusPartialContent || response.snapHeader.Get("Content-Range") != "" {
 		return false, now().Add(config.LockTimeout)
 	}
 
+	// Missing objects are stored for their own TTL, whatever their headers and the rules say
+	if response.Code == http.StatusNotFound {
+		if ttl := config.negativeTTL(); ttl > 0 {
+			return true, now().Add(ttl)
+		}
+		return false, now().Add(config.LockTimeout)
+	}
+
 	reasonsNotToCache, expiration, err := cacheobject.UsingRequestResponse(req, response.Code, response.snapHeader, false)
 
 	// err means there was an error parsing headers
@@ -90,7 +99,7 @@ func getCacheableStatus(req *http.Request, response *Response, config *Config) (
 }
 
 func matchesVary(currentRequest *http.Request, entry *HTTPCacheEntry) bool {
-	vary := entry.Response.HeaderMap.Get("Vary")
+	vary := strings.Join(entry.Response.HeaderMap["Vary"], ",")
 
 	for _, searchedHeader := range strings.Split(vary, ",") {
 		searchedHeader = strings.TrimSpace(searchedHeader)
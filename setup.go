@@ -26,8 +26,8 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return err
 	}
-	if _, err := os.Stat(config.Path); os.IsNotExist(err) {
-		err := os.Mkdir(config.Path, os.ModePerm)
+	if _, err := os.Stat(config.storagePath()); os.IsNotExist(err) {
+		err := os.MkdirAll(config.storagePath(), os.ModePerm)
 		if err != nil {
 			return err
 		}
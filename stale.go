@@ -0,0 +1,138 @@
+package gcsproxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+const (
+	// cacheStale is an expired entry served while it is revalidated or because GCS failed
+	cacheStale = "stale"
+
+	warningStale            = `110 - "Response is Stale"`
+	warningRevalidateFailed = `111 - "Revalidation Failed"`
+)
+
+// staleWindows returns how long an expired response can be served while it is revalidated
+// and how long when GCS fails. The RFC 5861 directives of the response win over the defaults
+func staleWindows(response *Response, config *Config) (time.Duration, time.Duration) {
+	whileRevalidate, ifError := config.StaleWhileRevalidate, config.StaleIfError
+
+	directives, err := cacheobject.ParseResponseCacheControl(response.snapHeader.Get("Cache-Control"))
+	if err != nil {
+		return whileRevalidate, ifError
+	}
+	// The origin asked to never serve the response once it is stale
+	if directives.MustRevalidate || directives.ProxyRevalidate || directives.NoCachePresent {
+		return 0, 0
+	}
+	if directives.StaleWhileRevalidate >= 0 {
+		whileRevalidate = time.Duration(directives.StaleWhileRevalidate) * time.Second
+	}
+	if directives.StaleIfError >= 0 {
+		ifError = time.Duration(directives.StaleIfError) * time.Second
+	}
+	return whileRevalidate, ifError
+}
+
+// graceEnd is when the entry can no longer be served, even stale
+func (e *HTTPCacheEntry) graceEnd() time.Time {
+	grace := e.staleWhileRevalidate
+	if e.staleIfError > grace {
+		grace = e.staleIfError
+	}
+	return e.expiration.Add(grace)
+}
+
+// Stale returns if the entry expired but can still be served in some case
+func (e *HTTPCacheEntry) Stale() bool {
+	now := time.Now()
+	return e.isPublic && !e.Response.Failed() && !e.expiration.After(now) && e.graceEnd().After(now)
+}
+
+// servableWhileRevalidating returns if the stale entry can be served while a new one is fetched
+func (e *HTTPCacheEntry) servableWhileRevalidating() bool {
+	return e.expiration.Add(e.staleWhileRevalidate).After(time.Now())
+}
+
+// servableOnError returns if the stale entry can be served because GCS failed
+func (e *HTTPCacheEntry) servableOnError() bool {
+	return e.expiration.Add(e.staleIfError).After(time.Now())
+}
+
+// revalidations makes sure there is only one background revalidation for each key
+type revalidations struct {
+	mutex sync.Mutex
+	keys  map[string]bool
+}
+
+func newRevalidations() *revalidations {
+	return &revalidations{keys: make(map[string]bool)}
+}
+
+// start returns false if the key is already being revalidated
+func (r *revalidations) start(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.keys[key] {
+		return false
+	}
+	r.keys[key] = true
+	return true
+}
+
+func (r *revalidations) done(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.keys, key)
+}
+
+// detachedContext keeps the values of the request, like the original URL used by the cache key,
+// but it is not canceled when the request ends
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// revalidate fetches the object in background and replaces the cached entry
+func (handler *Handler) revalidate(r *http.Request) {
+	key := getKey(handler.Config.CacheKeyTemplate, r)
+	if !handler.revalidations.start(key) {
+		return
+	}
+
+	// The client request ends before the revalidation
+	req := r.WithContext(detachedContext{r.Context()})
+	go func() {
+		defer handler.revalidations.done(key)
+
+		entry, err := handler.fetchUpstream(req)
+		if err != nil {
+			log.Printf("[ERROR] gcs: revalidating %s: %v", req.URL.Path, err)
+			return
+		}
+		// The body is stored even if the entry is private, nobody else reads it
+		if err := entry.setStorage(handler.Config); err != nil {
+			log.Printf("[ERROR] gcs: revalidating %s: %v", req.URL.Path, err)
+			return
+		}
+		handler.Cache.Put(req, entry)
+	}()
+}
+
+// serveStale answers with an expired entry and the warning of why it is stale
+func (handler *Handler) serveStale(w http.ResponseWriter, r *http.Request, entry *HTTPCacheEntry, warning string) (int, error) {
+	w.Header().Add("Warning", warning)
+	return handler.respond(w, r, entry, cacheStale)
+}
@@ -21,6 +21,9 @@ type Stats struct {
 
 	Bypass      uint64
 	bypassMutex sync.Mutex
+
+	Negative      uint64
+	negativeMutex sync.Mutex
 }
 
 func NewStats() *Stats {
@@ -36,13 +39,16 @@ func (s *Stats) reset() {
 	s.missMutex.Unlock()
 	s.skipMutex.Lock()
 	s.Skip = 0
-	s.errorMutex.Unlock()
+	s.skipMutex.Unlock()
 	s.bypassMutex.Lock()
 	s.Bypass = 0
 	s.bypassMutex.Unlock()
 	s.errorMutex.Lock()
 	s.Error = 0
 	s.errorMutex.Unlock()
+	s.negativeMutex.Lock()
+	s.Negative = 0
+	s.negativeMutex.Unlock()
 }
 func (s *Stats) Inc(status string) {
 
@@ -67,7 +73,7 @@ func (s *Stats) Inc(status string) {
 		}
 		s.skipMutex.Lock()
 		s.Skip += 1
-		s.errorMutex.Unlock()
+		s.skipMutex.Unlock()
 	case "bypass":
 		if s.Bypass == MaxUint64 {
 			s.reset()
@@ -82,11 +88,26 @@ func (s *Stats) Inc(status string) {
 		s.errorMutex.Lock()
 		s.Error += 1
 		s.errorMutex.Unlock()
+	case "negative":
+		if s.Negative == MaxUint64 {
+			s.reset()
+		}
+		s.negativeMutex.Lock()
+		s.Negative += 1
+		s.negativeMutex.Unlock()
 	}
 }
 
 func (s *Stats) String() string {
-	b, err := json.Marshal(*s)
+	b, err := json.Marshal(map[string]uint64{
+		"Size":     s.Size,
+		"Hit":      s.Hit,
+		"Miss":     s.Miss,
+		"Error":    s.Error,
+		"Skip":     s.Skip,
+		"Bypass":   s.Bypass,
+		"Negative": s.Negative,
+	})
 	if err != nil {
 		return ""
 	}
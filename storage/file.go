@@ -1,6 +1,10 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -10,6 +14,7 @@ import (
 type FileStorage struct {
 	file         *os.File
 	subscription *Subscription
+	checksum     hash.Hash
 }
 
 // NewFileStorage creates a new temp file that will be used as a the storage of the cache entry
@@ -21,12 +26,55 @@ func NewFileStorage(path string) (ResponseStorage, error) {
 	return &FileStorage{
 		file:         file,
 		subscription: NewSubscription(),
+		checksum:     sha256.New(),
+	}, nil
+}
+
+// OpenFileStorage opens a file written by a previous FileStorage
+// The content is already complete, it should be closed before reading it
+func OpenFileStorage(name string) (*FileStorage, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{
+		file:         file,
+		subscription: NewSubscription(),
+		checksum:     sha256.New(),
 	}, nil
 }
 
 func (f *FileStorage) Write(p []byte) (n int, err error) {
 	defer f.subscription.NotifyAll(len(p))
-	return f.file.Write(p)
+	n, err = f.file.Write(p)
+	f.checksum.Write(p[:n])
+	return n, err
+}
+
+// Name returns the path of the underlying file
+func (f *FileStorage) Name() string {
+	return f.file.Name()
+}
+
+// Checksum returns the hex encoded SHA-256 of the written content
+// It should be called once the storage is closed
+func (f *FileStorage) Checksum() string {
+	return hex.EncodeToString(f.checksum.Sum(nil))
+}
+
+// FileChecksum returns the hex encoded SHA-256 of a file and its size
+func FileChecksum(name string) (string, int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	checksum := sha256.New()
+	size, err := io.Copy(checksum, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(checksum.Sum(nil)), size, nil
 }
 
 // Flush syncs the underlying file
@@ -80,6 +128,17 @@ func (r *FileReader) Read(p []byte) (n int, err error) {
 	return r.content.Read(p)
 }
 
+// Seek moves the read offset of the underlying content.
+// Seeking past the written content is allowed, next reads will
+// wait until the content at that offset is written.
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := r.content.(io.Seeker)
+	if !ok {
+		return 0, errors.New("Content is not seekable")
+	}
+	return seeker.Seek(offset, whence)
+}
+
 // Close closes the underlying storage
 func (r *FileReader) Close() error {
 	err := r.content.Close()
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// errCleaned is returned by the readers of a cleaned MemoryStorage, its content is gone
+var errCleaned = errors.New("Content was cleaned")
+
+// MemoryStorage saves the content in memory
+// It is meant for small objects, it avoids the files of FileStorage
+type MemoryStorage struct {
+	content      []byte
+	cleaned      bool
+	contentLock  *sync.RWMutex
+	subscription *Subscription
+	release      func()
+	releaseOnce  sync.Once
+}
+
+// NewMemoryStorage creates a storage for about capacity bytes
+// release is called when the storage is cleaned, it can be nil
+func NewMemoryStorage(capacity int64, release func()) *MemoryStorage {
+	return &MemoryStorage{
+		content:      make([]byte, 0, capacity),
+		contentLock:  new(sync.RWMutex),
+		subscription: NewSubscription(),
+		release:      release,
+	}
+}
+
+func (m *MemoryStorage) Write(p []byte) (n int, err error) {
+	defer m.subscription.NotifyAll(len(p))
+	m.contentLock.Lock()
+	defer m.contentLock.Unlock()
+	m.content = append(m.content, p...)
+	return len(p), nil
+}
+
+// Flush notifies the readers, there is nothing to sync
+func (m *MemoryStorage) Flush() error {
+	m.subscription.NotifyAll(0)
+	return nil
+}
+
+// Clean frees the content
+func (m *MemoryStorage) Clean() error {
+	m.subscription.WaitAll() // Wait until every subscriber ends waiting every result
+	m.contentLock.Lock()
+	m.content = nil
+	m.cleaned = true
+	m.contentLock.Unlock()
+	m.releaseOnce.Do(func() {
+		if m.release != nil {
+			m.release()
+		}
+	})
+	return nil
+}
+
+// Close means there won't be more writes
+func (m *MemoryStorage) Close() error {
+	m.subscription.Close()
+	return nil
+}
+
+// GetReader returns a new reader of the content from the start
+// It fails once the storage is cleaned
+func (m *MemoryStorage) GetReader() (io.ReadCloser, error) {
+	m.contentLock.RLock()
+	cleaned := m.cleaned
+	m.contentLock.RUnlock()
+	if cleaned {
+		return nil, errCleaned
+	}
+	return &FileReader{
+		content:      &memoryContent{storage: m},
+		subscription: m.subscription.NewSubscriber(),
+		unsubscribe:  m.subscription.RemoveSubscriber,
+	}, nil
+}
+
+/////////////////////////////////////////
+
+// memoryContent reads the content of a MemoryStorage from its own offset
+type memoryContent struct {
+	storage *MemoryStorage
+	offset  int64
+}
+
+func (c *memoryContent) Read(p []byte) (int, error) {
+	c.storage.contentLock.RLock()
+	defer c.storage.contentLock.RUnlock()
+	if c.storage.cleaned {
+		return 0, errCleaned
+	}
+	if c.offset >= int64(len(c.storage.content)) {
+		return 0, io.EOF
+	}
+	n := copy(p, c.storage.content[c.offset:])
+	c.offset += int64(n)
+	return n, nil
+}
+
+// Seek moves the offset, it can be past the written content like a file
+func (c *memoryContent) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		c.storage.contentLock.RLock()
+		offset += int64(len(c.storage.content))
+		c.storage.contentLock.RUnlock()
+	default:
+		return 0, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	c.offset = offset
+	return offset, nil
+}
+
+func (c *memoryContent) Close() error {
+	return nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestMemoryStorageClean(t *testing.T) {
+	released := 0
+	m := NewMemoryStorage(5, func() { released++ })
+	m.Write([]byte("hello"))
+	m.Close()
+
+	reader, err := m.GetReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil || string(content) != "hello" {
+		t.Fatalf("read %q error %v", content, err)
+	}
+	reader.Close()
+
+	m.Clean()
+	m.Clean()
+	if released != 1 {
+		t.Errorf("released %d times, want once", released)
+	}
+	if m.content != nil {
+		t.Errorf("the content was not freed")
+	}
+
+	// The readers can not see the content anymore
+	if _, err := m.GetReader(); err != errCleaned {
+		t.Errorf("GetReader error %v after Clean, want %v", err, errCleaned)
+	}
+	if n, err := reader.Read(make([]byte, 5)); n != 0 || err != errCleaned {
+		t.Errorf("read %d bytes error %v after Clean, want %v", n, err, errCleaned)
+	}
+}
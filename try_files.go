@@ -0,0 +1,69 @@
+package gcsproxy
+
+import (
+	"strings"
+)
+
+// tryFiles returns the objects to look up for the object name, in order
+// Each candidate replaces {object} with the name, like try_files {object} {object}.html {object}/index.html /index.html.
+// The rewrites are applied to every candidate, without candidates only the object itself is looked up
+func tryFiles(candidates []string, rewrite *RewriteConfig, name string) []string {
+	if len(candidates) == 0 {
+		return []string{rewrite.apply(name)}
+	}
+
+	objects := make([]string, 0, len(candidates))
+	seen := make(map[string]bool, len(candidates))
+	for _, candidate := range candidates {
+		object := strings.Replace(candidate, "{object}", name, -1)
+		object = rewrite.apply(strings.TrimLeft(object, "/"))
+		// The root request makes some candidates empty or equal to others
+		if object == "" || seen[object] {
+			continue
+		}
+		seen[object] = true
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+// readerNames returns the object names whose lookups can find the object of the name, the name itself included
+// It is the reverse of tryFiles. The candidates without {object} are shared by every name, they are ignored
+func readerNames(candidates []string, rewrite *RewriteConfig, name string) []string {
+	// The index document is appended to the directories
+	equivalents := []string{name}
+	if rewrite != nil && rewrite.IndexDocument != "" && (name == rewrite.IndexDocument || strings.HasSuffix(name, "/"+rewrite.IndexDocument)) {
+		directory := strings.TrimSuffix(name, rewrite.IndexDocument)
+		equivalents = append(equivalents, directory)
+		// The directory without trailing slash is redirected if the index document exists
+		if directory != "" {
+			equivalents = append(equivalents, strings.TrimSuffix(directory, "/"))
+		}
+	}
+	if len(candidates) == 0 {
+		return equivalents
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, equivalent := range equivalents {
+		for _, candidate := range candidates {
+			i := strings.Index(candidate, "{object}")
+			if i < 0 {
+				continue
+			}
+			prefix := strings.TrimLeft(candidate[:i], "/")
+			suffix := candidate[i+len("{object}"):]
+			if strings.Contains(suffix, "{object}") || len(equivalent) < len(prefix)+len(suffix) ||
+				!strings.HasPrefix(equivalent, prefix) || !strings.HasSuffix(equivalent, suffix) {
+				continue
+			}
+			reader := equivalent[len(prefix) : len(equivalent)-len(suffix)]
+			if !seen[reader] {
+				seen[reader] = true
+				names = append(names, reader)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,54 @@
+package gcsproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestReaderNames(t *testing.T) {
+	index := &RewriteConfig{IndexDocument: "index.html"}
+	tests := []struct {
+		name       string
+		candidates []string
+		rewrite    *RewriteConfig
+		object     string
+		want       []string
+	}{
+		{"no try_files", nil, nil, "docs/page.html", []string{"docs/page.html"}},
+		{"extension", []string{"{object}", "{object}.html"}, nil, "docs/page.html", []string{"docs/page.html", "docs/page"}},
+		{"leading slash", []string{"/{object}", "/{object}.html"}, nil, "page.html", []string{"page.html", "page"}},
+		{"directory index", []string{"{object}", "{object}/index.html"}, nil, "docs/index.html", []string{"docs/index.html", "docs"}},
+		{"fallback ignored", []string{"{object}", "/index.html"}, nil, "index.html", []string{"index.html"}},
+		{"suffix does not match", []string{"{object}.html"}, nil, "docs/page.txt", nil},
+		{"index document", nil, index, "docs/index.html", []string{"docs/index.html", "docs/", "docs"}},
+		{"root index document", nil, index, "index.html", []string{"index.html", ""}},
+		{"index document and try_files", []string{"{object}", "{object}.html"}, index, "docs/index.html", []string{"docs/index.html", "docs/index", "docs/", "docs"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := readerNames(test.candidates, test.rewrite, test.object)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readers %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestWithName(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPut, "http://example.com/site/docs/page.html", nil)
+	r = r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+
+	reader := requestWithName(r, "docs/page.html", "docs/page")
+	want := "PUT example.com/site/docs/page?"
+	if got := getKey(defaultCacheKeyTemplate, reader); got != want {
+		t.Errorf("key %q, want %q", got, want)
+	}
+	if r.URL.Path != "/site/docs/page.html" {
+		t.Errorf("the request was modified: %s", r.URL.Path)
+	}
+}
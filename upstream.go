@@ -0,0 +1,191 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// maxV4Expiry is the longest lifetime allowed by GCS for V4 signed URLs
+const maxV4Expiry = 7 * 24 * time.Hour
+
+// parseSigningScheme parses the name of a signing scheme
+func parseSigningScheme(name string) (storage.SigningScheme, error) {
+	switch strings.ToLower(name) {
+	case "v2":
+		return storage.SigningSchemeV2, nil
+	case "v4":
+		return storage.SigningSchemeV4, nil
+	default:
+		return storage.SigningSchemeDefault, fmt.Errorf("unknown signing scheme %s, expected v2 or v4", name)
+	}
+}
+
+// resolveSigning sets the defaults of the signing options of the bucket and validates them
+// V4 is the default scheme except for HMAC keys, that can only sign V2 URLs
+func (bucket *Bucket) resolveSigning(defaultExpiry time.Duration) error {
+	_, isHMAC := bucket.Credentials.(*hmacCredential)
+	switch bucket.SigningScheme {
+	case storage.SigningSchemeDefault:
+		if isHMAC {
+			bucket.SigningScheme = storage.SigningSchemeV2
+		} else {
+			bucket.SigningScheme = storage.SigningSchemeV4
+		}
+	case storage.SigningSchemeV4:
+		if isHMAC {
+			return fmt.Errorf("bucket %s: v4 signing is not supported with hmac keys", bucket.Name)
+		}
+	}
+
+	if bucket.URLExpiry == 0 {
+		bucket.URLExpiry = defaultExpiry
+	}
+	if bucket.SigningScheme == storage.SigningSchemeV4 && bucket.URLExpiry > maxV4Expiry {
+		return fmt.Errorf("bucket %s: url_expiry %s exceeds the maximum of %s for v4 signing", bucket.Name, bucket.URLExpiry, maxV4Expiry)
+	}
+	return nil
+}
+
+// parseEndpoint validates the URL of a GCS compatible endpoint
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint %s must use http or https", endpoint)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("endpoint %s has no host", endpoint)
+	}
+	return u, nil
+}
+
+// endpointURL returns the path style URL /bucket/object of the object on the endpoint
+func endpointURL(endpoint *url.URL, bucket string, object string) string {
+	u := *endpoint
+	u.Path = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpoint.Path, "/"), bucket, object)
+	u.RawPath = ""
+	u.RawQuery = ""
+	return u.String()
+}
+
+// signedURL returns a signed URL to access the object in the bucket with the given method
+func (bucket *Bucket) signedURL(object string, method string) (string, error) {
+	return bucket.sign(object, &storage.SignedURLOptions{Method: method})
+}
+
+// sign completes the options with the expiration and scheme of the bucket
+// and returns the signed URL for the object
+// The URLs of custom endpoints are not signed, the signatures cover the host storage.googleapis.com
+// so endpoints are only meant for emulators that do not check them
+func (bucket *Bucket) sign(object string, opts *storage.SignedURLOptions) (string, error) {
+	if bucket.Endpoint != nil {
+		return endpointURL(bucket.Endpoint, bucket.Name, object), nil
+	}
+	opts.Expires = time.Now().Add(bucket.URLExpiry)
+	opts.Scheme = bucket.SigningScheme
+	return bucket.Credentials.SignedURL(bucket.Name, object, opts)
+}
+
+// UpstreamError is returned when an object could not be fetched from a bucket
+type UpstreamError struct {
+	Bucket string
+	Object string
+	// Code is the status code answered by GCS, 0 if there was no answer
+	Code int
+	// Status is the status code that should be sent to the client
+	Status int
+	Err    error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("gcs: bucket %s: object %s: %v", e.Bucket, e.Object, e.Err)
+}
+
+// Misconfigured returns if GCS rejected the credentials of the bucket
+func (e *UpstreamError) Misconfigured() bool {
+	return e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden
+}
+
+// upstreamStatus returns the status code to send to the client for the error
+func upstreamStatus(err error) int {
+	if upstreamErr, ok := err.(*UpstreamError); ok {
+		return upstreamErr.Status
+	}
+	return http.StatusBadGateway
+}
+
+// statusError builds the error for a non 200 response of GCS
+func (bucket *Bucket) statusError(object string, code int) *UpstreamError {
+	status := http.StatusBadGateway
+	if code == http.StatusNotFound || code == http.StatusPreconditionFailed {
+		status = code
+	}
+	return &UpstreamError{
+		Bucket: bucket.Name,
+		Object: object,
+		Code:   code,
+		Status: status,
+		Err:    fmt.Errorf("unexpected status %d", code),
+	}
+}
+
+// signingError builds the error for a URL that could not be signed
+func (bucket *Bucket) signingError(object string, err error) *UpstreamError {
+	return &UpstreamError{
+		Bucket: bucket.Name,
+		Object: object,
+		Status: http.StatusInternalServerError,
+		Err:    fmt.Errorf("signing URL with %s: %v", bucket.Credentials.Name(), err),
+	}
+}
+
+// transportError builds the error for a request that got no response from GCS
+func (bucket *Bucket) transportError(object string, err error) *UpstreamError {
+	status := http.StatusBadGateway
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		status = http.StatusGatewayTimeout
+	}
+	return &UpstreamError{
+		Bucket: bucket.Name,
+		Object: object,
+		Status: status,
+		Err:    err,
+	}
+}
+
+// fetch requests the object to GCS with the given method. It returns an *UpstreamError
+// unless the object is found. The body of the response must be closed
+func (bucket *Bucket) fetch(client *UpstreamClient, method string, object string, req *http.Request) (*http.Response, error) {
+	url, err := bucket.signedURL(object, method)
+	if err != nil {
+		return nil, bucket.signingError(object, err)
+	}
+
+	upstreamReq, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, bucket.transportError(object, err)
+	}
+	// Forward Accept-Encoding so objects stored with Content-Encoding
+	// are not decompressed by GCS or by the http client
+	if acceptEncoding := req.Header.Get("Accept-Encoding"); acceptEncoding != "" {
+		upstreamReq.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	res, err := client.Do(req.Context(), upstreamReq)
+	if err != nil {
+		return nil, bucket.transportError(object, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, bucket.statusError(object, res.StatusCode)
+	}
+	return res, nil
+}
@@ -4,22 +4,78 @@ import (
 	"hash/crc32"
 	"math"
 	"sync"
+	"time"
 )
 
 const urlLockBucketsSize = 256
 
+// URLLock serializes the requests for the same key
+// The state of a key only lives while some request holds or waits for its lock
 type URLLock struct {
 	globalLocks [urlLockBucketsSize]*sync.Mutex
-	keys        [urlLockBucketsSize]map[string]*sync.Mutex
+	keys        [urlLockBucketsSize]map[string]*URLMutex
+}
+
+// URLMutex is a mutex that can be acquired with a timeout
+// A nil URLMutex is a lock that was not acquired, Unlock does nothing
+type URLMutex struct {
+	c chan struct{}
+
+	owner  *URLLock
+	key    string
+	bucket uint32
+	// refs counts the holder and the waiters, it is guarded by the lock of the bucket
+	refs int
+}
+
+func newURLMutex(owner *URLLock, key string, bucket uint32) *URLMutex {
+	return &URLMutex{
+		c:      make(chan struct{}, 1),
+		owner:  owner,
+		key:    key,
+		bucket: bucket,
+	}
+}
+
+// lock waits at most timeout to acquire the mutex, 0 waits forever
+func (m *URLMutex) lock(timeout time.Duration) bool {
+	if timeout <= 0 {
+		m.c <- struct{}{}
+		return true
+	}
+
+	// The timer is only needed if the mutex is held
+	select {
+	case m.c <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case m.c <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (m *URLMutex) Unlock() {
+	if m == nil {
+		return
+	}
+	<-m.c
+	m.owner.release(m)
 }
 
 func NewURLLock() *URLLock {
 	globalLocks := [urlLockBucketsSize]*sync.Mutex{}
-	keys := [urlLockBucketsSize]map[string]*sync.Mutex{}
+	keys := [urlLockBucketsSize]map[string]*URLMutex{}
 
 	for i := 0; i < int(urlLockBucketsSize); i++ {
 		globalLocks[i] = new(sync.Mutex)
-		keys[i] = make(map[string]*sync.Mutex)
+		keys[i] = make(map[string]*URLMutex)
 	}
 
 	return &URLLock{
@@ -28,19 +84,47 @@ func NewURLLock() *URLLock {
 	}
 }
 
-// Adquire a lock for given key
-func (allLocks *URLLock) Adquire(key string) *sync.Mutex {
+// Adquire a lock for given key waiting at most timeout, 0 waits forever
+// If the lock is not acquired in time it returns a nil lock and false
+func (allLocks *URLLock) Adquire(key string, timeout time.Duration) (*URLMutex, bool) {
 	bucketIndex := allLocks.getBucketIndexForKey(key)
 	allLocks.globalLocks[bucketIndex].Lock()
-	defer allLocks.globalLocks[bucketIndex].Unlock()
-
 	lock, exists := allLocks.keys[bucketIndex][key]
 	if !exists {
-		lock = new(sync.Mutex)
+		lock = newURLMutex(allLocks, key, bucketIndex)
 		allLocks.keys[bucketIndex][key] = lock
 	}
-	lock.Lock()
-	return lock
+	lock.refs++
+	// The bucket is released before waiting, other keys must not wait for this one
+	allLocks.globalLocks[bucketIndex].Unlock()
+
+	if !lock.lock(timeout) {
+		allLocks.release(lock)
+		return nil, false
+	}
+	return lock, true
+}
+
+// Len returns the number of keys that are locked or waited for
+func (allLocks *URLLock) Len() int {
+	n := 0
+	for i := range allLocks.keys {
+		allLocks.globalLocks[i].Lock()
+		n += len(allLocks.keys[i])
+		allLocks.globalLocks[i].Unlock()
+	}
+	return n
+}
+
+// release drops a reference to the lock and frees the key when nobody holds or waits for it
+func (allLocks *URLLock) release(lock *URLMutex) {
+	allLocks.globalLocks[lock.bucket].Lock()
+	defer allLocks.globalLocks[lock.bucket].Unlock()
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(allLocks.keys[lock.bucket], lock.key)
+	}
 }
 
 func (allLocks *URLLock) getBucketIndexForKey(key string) uint32 {
@@ -0,0 +1,75 @@
+package gcsproxy
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkURLLockUniqueKeys locks a different key every time, like a site with millions of objects
+func BenchmarkURLLockUniqueKeys(b *testing.B) {
+	locks := NewURLLock()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lock, _ := locks.Adquire("GET example.com/objects/"+strconv.Itoa(i)+"?", 0)
+		lock.Unlock()
+	}
+	b.StopTimer()
+	if n := locks.Len(); n != 0 {
+		b.Fatalf("%d keys were not freed", n)
+	}
+}
+
+// BenchmarkURLLockUniqueKeysParallel locks different keys from many goroutines
+func BenchmarkURLLockUniqueKeysParallel(b *testing.B) {
+	locks := NewURLLock()
+	var counter int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&counter, 1)
+			lock, _ := locks.Adquire("GET example.com/objects/"+strconv.FormatInt(i, 10)+"?", 0)
+			lock.Unlock()
+		}
+	})
+	b.StopTimer()
+	if n := locks.Len(); n != 0 {
+		b.Fatalf("%d keys were not freed", n)
+	}
+}
+
+// BenchmarkURLLockHotKeysParallel makes many goroutines wait for a few keys
+func BenchmarkURLLockHotKeysParallel(b *testing.B) {
+	locks := NewURLLock()
+	var counter int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&counter, 1)
+			lock, _ := locks.Adquire("GET example.com/hot/"+strconv.FormatInt(i%8, 10)+"?", 0)
+			lock.Unlock()
+		}
+	})
+	b.StopTimer()
+	if n := locks.Len(); n != 0 {
+		b.Fatalf("%d keys were not freed", n)
+	}
+}
+
+// BenchmarkURLLockUniqueKeysTimeout locks different keys with the lock timeout of the handler
+func BenchmarkURLLockUniqueKeysTimeout(b *testing.B) {
+	locks := NewURLLock()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lock, _ := locks.Adquire("GET example.com/objects/"+strconv.Itoa(i)+"?", defaultLockTimeout)
+		lock.Unlock()
+	}
+	b.StopTimer()
+	if n := locks.Len(); n != 0 {
+		b.Fatalf("%d keys were not freed", n)
+	}
+}
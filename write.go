@@ -0,0 +1,525 @@
+package gcsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+var (
+	defaultWriteMethods       = []string{"PUT", "POST", "DELETE"}
+	defaultResumableThreshold = int64(8 * 1024 * 1024)
+	defaultChunkSize          = int64(8 * 1024 * 1024)
+)
+
+// resumableChunkMultiple is the granularity required by GCS for the chunks of a resumable upload
+const resumableChunkMultiple = 256 * 1024
+
+// AuthRule determines if a request is allowed to modify objects
+type AuthRule interface {
+	authorizes(*http.Request) bool
+}
+
+// HeaderAuthRule authorizes requests with the given value in Header
+type HeaderAuthRule struct {
+	Header string
+	Value  string
+}
+
+// BasicAuthRule authorizes requests with the given basic auth credentials
+type BasicAuthRule struct {
+	User     string
+	Password string
+}
+
+// AnyAuthRule authorizes every request
+type AnyAuthRule struct{}
+
+func (rule *HeaderAuthRule) authorizes(req *http.Request) bool {
+	value := req.Header.Get(rule.Header)
+	return value != "" && subtle.ConstantTimeCompare([]byte(value), []byte(rule.Value)) == 1
+}
+
+func (rule *BasicAuthRule) authorizes(req *http.Request) bool {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(rule.User)) == 1
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(rule.Password)) == 1
+	return userMatch && passwordMatch
+}
+
+func (rule *AnyAuthRule) authorizes(req *http.Request) bool {
+	return true
+}
+
+// WriteConfig enables uploads and deletes of objects in the first bucket
+type WriteConfig struct {
+	Methods []string
+	// Paths limits the writes to the requests starting with any of them
+	Paths []string
+	// AuthRules authorize the writes, any matching rule is enough
+	AuthRules []AuthRule
+	// Bodies bigger than ResumableThreshold or without length are uploaded in chunks
+	ResumableThreshold int64
+	ChunkSize          int64
+}
+
+func defaultWriteConfig() *WriteConfig {
+	return &WriteConfig{
+		Methods:            defaultWriteMethods,
+		ResumableThreshold: defaultResumableThreshold,
+		ChunkSize:          defaultChunkSize,
+	}
+}
+
+func (config *WriteConfig) matches(req *http.Request) bool {
+	methodMatches := false
+	for _, method := range config.Methods {
+		if req.Method == method {
+			methodMatches = true
+			break
+		}
+	}
+	if !methodMatches {
+		return false
+	}
+	if len(config.Paths) == 0 {
+		return true
+	}
+	for _, path := range config.Paths {
+		if strings.HasPrefix(req.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *WriteConfig) authorizes(req *http.Request) bool {
+	for _, rule := range config.AuthRules {
+		if rule.authorizes(req) {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *WriteConfig) usesBasicAuth() bool {
+	for _, rule := range config.AuthRules {
+		if _, ok := rule.(*BasicAuthRule); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// serveWrite uploads or deletes the object in the first bucket of the route
+func (handler *Handler) serveWrite(w http.ResponseWriter, r *http.Request) (int, error) {
+	config := handler.Config.Write
+	if !config.authorizes(r) {
+		if config.usesBasicAuth() {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gcs"`)
+		}
+		return http.StatusUnauthorized, nil
+	}
+
+	t := handler.target(r)
+	object := t.object
+	if object == "" || strings.HasSuffix(object, "/") {
+		return http.StatusBadRequest, nil
+	}
+	bucket := t.buckets[0]
+
+	preconditions, err := handler.writePreconditions(bucket, object, r)
+	if err != nil {
+		return upstreamStatus(err), err
+	}
+	if preconditions == nil {
+		return http.StatusPreconditionFailed, nil
+	}
+
+	var res *http.Response
+	if r.Method == http.MethodDelete {
+		res, err = handler.deleteObject(bucket, object, preconditions)
+	} else if r.ContentLength < 0 || r.ContentLength > config.ResumableThreshold {
+		res, err = handler.uploadResumable(bucket, object, r, preconditions)
+	} else {
+		res, err = handler.uploadObject(bucket, object, r, preconditions)
+	}
+	if err != nil {
+		// A failed precondition is an answer for the client, not an error
+		if upstreamStatus(err) == http.StatusPreconditionFailed {
+			return http.StatusPreconditionFailed, nil
+		}
+		return upstreamStatus(err), err
+	}
+	defer res.Body.Close()
+
+	handler.invalidate(r, t)
+
+	copyUpstreamHeaders(res.Header, w.Header(), handler.Config.GoogHeaders)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(res.StatusCode)
+	return res.StatusCode, nil
+}
+
+// writePreconditions translates If-Match and If-None-Match into a GCS generation precondition.
+// It returns a nil slice if the preconditions fail
+func (handler *Handler) writePreconditions(bucket *Bucket, object string, r *http.Request) ([]string, error) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return []string{}, nil
+	}
+	if ifMatch == "" && strings.TrimSpace(ifNoneMatch) == "*" {
+		return []string{"x-goog-if-generation-match:0"}, nil
+	}
+
+	// The ETag is compared here and the generation is sent to GCS
+	// so the object can not change between the check and the write
+	exists := true
+	res, err := bucket.fetch(handler.Client, http.MethodHead, object, r)
+	if err != nil {
+		upstreamErr, ok := err.(*UpstreamError)
+		if !ok || upstreamErr.Status != http.StatusNotFound {
+			return nil, err
+		}
+		exists = false
+	} else {
+		res.Body.Close()
+	}
+
+	header := http.Header{}
+	if exists {
+		header = res.Header
+	}
+	if ifMatch != "" && (!exists || checkIfMatch(r, header) == condFalse) {
+		return nil, nil
+	}
+	if ifNoneMatch != "" && exists && checkIfNoneMatch(r, header) == condFalse {
+		return nil, nil
+	}
+
+	if !exists {
+		return []string{"x-goog-if-generation-match:0"}, nil
+	}
+	generation := header.Get("X-Goog-Generation")
+	if generation == "" {
+		return []string{}, nil
+	}
+	return []string{"x-goog-if-generation-match:" + generation}, nil
+}
+
+// sendWrite sends a request that modifies the object and checks the answer of GCS
+func (handler *Handler) sendWrite(bucket *Bucket, object string, upstreamReq *http.Request, accepted ...int) (*http.Response, error) {
+	res, err := handler.Client.DoOnce(upstreamReq)
+	if err != nil {
+		return nil, bucket.transportError(object, err)
+	}
+	for _, code := range accepted {
+		if res.StatusCode == code {
+			return res, nil
+		}
+	}
+	res.Body.Close()
+	upstreamErr := bucket.statusError(object, res.StatusCode)
+	if upstreamErr.Misconfigured() {
+		log.Printf("[ERROR] gcs: write denied to bucket %s, check its credentials: %v", bucket.Name, upstreamErr)
+	}
+	return nil, upstreamErr
+}
+
+func (handler *Handler) deleteObject(bucket *Bucket, object string, preconditions []string) (*http.Response, error) {
+	url, err := bucket.sign(object, &storage.SignedURLOptions{Method: http.MethodDelete, Headers: preconditions})
+	if err != nil {
+		return nil, bucket.signingError(object, err)
+	}
+	upstreamReq, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return nil, bucket.transportError(object, err)
+	}
+	setHeaderLines(upstreamReq.Header, preconditions)
+	return handler.sendWrite(bucket, object, upstreamReq, http.StatusOK, http.StatusNoContent)
+}
+
+// uploadObject streams the body of the request to GCS in a single request
+func (handler *Handler) uploadObject(bucket *Bucket, object string, r *http.Request, preconditions []string) (*http.Response, error) {
+	contentType := r.Header.Get("Content-Type")
+	headers := append(metadataHeaders(r.Header), preconditions...)
+	url, err := bucket.sign(object, &storage.SignedURLOptions{Method: http.MethodPut, ContentType: contentType, Headers: headers})
+	if err != nil {
+		return nil, bucket.signingError(object, err)
+	}
+	upstreamReq, err := http.NewRequest(http.MethodPut, url, r.Body)
+	if err != nil {
+		return nil, bucket.transportError(object, err)
+	}
+	upstreamReq.ContentLength = r.ContentLength
+	copyWriteHeaders(r.Header, upstreamReq.Header)
+	setHeaderLines(upstreamReq.Header, headers)
+	return handler.sendWrite(bucket, object, upstreamReq, http.StatusOK, http.StatusCreated)
+}
+
+// uploadResumable starts a resumable upload session and sends the body in chunks.
+// A failed chunk is resent from the last offset persisted by GCS
+func (handler *Handler) uploadResumable(bucket *Bucket, object string, r *http.Request, preconditions []string) (*http.Response, error) {
+	contentType := r.Header.Get("Content-Type")
+	headers := append([]string{"x-goog-resumable:start"}, metadataHeaders(r.Header)...)
+	headers = append(headers, preconditions...)
+	url, err := bucket.sign(object, &storage.SignedURLOptions{Method: http.MethodPost, ContentType: contentType, Headers: headers})
+	if err != nil {
+		return nil, bucket.signingError(object, err)
+	}
+	startReq, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return nil, bucket.transportError(object, err)
+	}
+	copyWriteHeaders(r.Header, startReq.Header)
+	setHeaderLines(startReq.Header, headers)
+	res, err := handler.sendWrite(bucket, object, startReq, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	session := res.Header.Get("Location")
+	if session == "" {
+		return nil, &UpstreamError{Bucket: bucket.Name, Object: object, Code: res.StatusCode, Status: http.StatusBadGateway, Err: errors.New("resumable upload without session URI")}
+	}
+
+	chunkSize := handler.Config.Write.ChunkSize
+	body := bufio.NewReader(r.Body)
+	chunk := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(body, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			handler.cancelUpload(session)
+			return nil, &UpstreamError{Bucket: bucket.Name, Object: object, Status: http.StatusBadRequest, Err: fmt.Errorf("reading request body: %v", err)}
+		}
+		// The total size is only known once the body ends
+		last := err != nil
+		if !last {
+			if _, peekErr := body.Peek(1); peekErr == io.EOF {
+				last = true
+			}
+		}
+		total := int64(-1)
+		if last {
+			total = offset + int64(n)
+		}
+
+		res, err := handler.sendChunk(bucket, object, session, chunk[:n], offset, total)
+		if err != nil {
+			handler.cancelUpload(session)
+			return nil, err
+		}
+		if last {
+			return res, nil
+		}
+		res.Body.Close()
+		offset += int64(n)
+	}
+}
+
+// sendChunk uploads the chunk at offset. total is -1 until the last chunk.
+// Failed attempts are retried from the offset persisted by GCS, and so are
+// the chunks persisted only partially
+func (handler *Handler) sendChunk(bucket *Bucket, object string, session string, chunk []byte, offset int64, total int64) (*http.Response, error) {
+	sent := int64(0)
+	end := offset + int64(len(chunk))
+	var lastErr error
+	for attempt := 0; attempt <= handler.Client.config.Retries; {
+		upstreamReq, err := http.NewRequest(http.MethodPut, session, bytes.NewReader(chunk[sent:]))
+		if err != nil {
+			return nil, bucket.transportError(object, err)
+		}
+		upstreamReq.Header.Set("Content-Range", chunkRange(offset+sent, int64(len(chunk))-sent, total))
+
+		res, err := handler.Client.DoOnce(upstreamReq)
+		if err == nil {
+			switch {
+			case res.StatusCode == http.StatusOK || res.StatusCode == http.StatusCreated:
+				return res, nil
+			case res.StatusCode == 308 && total < 0:
+				persisted, err := persistedBytes(res)
+				if err == nil && persisted == end {
+					return res, nil
+				}
+				// GCS persisted only part of the chunk, the rest is sent again without counting an attempt
+				if err == nil && persisted > offset+sent && persisted < end {
+					res.Body.Close()
+					sent = persisted - offset
+					continue
+				}
+			case res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests && res.StatusCode != 308:
+				res.Body.Close()
+				return nil, bucket.statusError(object, res.StatusCode)
+			}
+			res.Body.Close()
+			lastErr = bucket.statusError(object, res.StatusCode)
+		} else {
+			lastErr = bucket.transportError(object, err)
+		}
+		attempt++
+
+		// Ask GCS how much of the chunk was persisted before retrying
+		persisted, err := handler.uploadedBytes(session, total)
+		if err != nil {
+			continue
+		}
+		if persisted < offset || persisted > end {
+			return nil, lastErr
+		}
+		sent = persisted - offset
+	}
+	return nil, lastErr
+}
+
+// uploadedBytes returns the amount of bytes persisted in the upload session
+func (handler *Handler) uploadedBytes(session string, total int64) (int64, error) {
+	statusReq, err := http.NewRequest(http.MethodPut, session, nil)
+	if err != nil {
+		return 0, err
+	}
+	if total < 0 {
+		statusReq.Header.Set("Content-Range", "bytes */*")
+	} else {
+		statusReq.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+	}
+	res, err := handler.Client.DoOnce(statusReq)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != 308 {
+		return 0, fmt.Errorf("unexpected status %d querying upload", res.StatusCode)
+	}
+	return persistedBytes(res)
+}
+
+// persistedBytes returns the amount of bytes persisted according to a 308 response
+// Range: bytes=0-N means N+1 bytes were persisted, no Range means none
+func persistedBytes(res *http.Response) (int64, error) {
+	persistedRange := res.Header.Get("Range")
+	if persistedRange == "" {
+		return 0, nil
+	}
+	i := strings.LastIndex(persistedRange, "-")
+	if i < 0 {
+		return 0, fmt.Errorf("invalid persisted range %s", persistedRange)
+	}
+	end, err := strconv.ParseInt(persistedRange[i+1:], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return end + 1, nil
+}
+
+// cancelUpload discards an unfinished upload session
+func (handler *Handler) cancelUpload(session string) {
+	cancelReq, err := http.NewRequest(http.MethodDelete, session, nil)
+	if err != nil {
+		return
+	}
+	res, err := handler.Client.DoOnce(cancelReq)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+}
+
+func chunkRange(start, length, total int64) string {
+	totalValue := "*"
+	if total >= 0 {
+		totalValue = strconv.FormatInt(total, 10)
+	}
+	if length == 0 {
+		return "bytes */" + totalValue
+	}
+	return fmt.Sprintf("bytes %d-%d/%s", start, start+length-1, totalValue)
+}
+
+// copyWriteHeaders copies the headers of the client that GCS stores as object metadata
+// Custom x-goog-meta-* headers are signed and set from metadataHeaders
+func copyWriteHeaders(from http.Header, to http.Header) {
+	for _, name := range []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language", "Cache-Control"} {
+		if value := from.Get(name); value != "" {
+			to.Set(name, value)
+		}
+	}
+}
+
+// metadataHeaders returns the x-goog-meta-* headers of the client as name:value lines
+// Extension headers must be part of the signature
+func metadataHeaders(header http.Header) []string {
+	var lines []string
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Goog-Meta-") {
+			lines = append(lines, strings.ToLower(name)+":"+strings.Join(values, ","))
+		}
+	}
+	return lines
+}
+
+// setHeaderLines sets headers given as name:value lines
+func setHeaderLines(header http.Header, lines []string) {
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		header.Set(line[:i], line[i+1:])
+	}
+}
+
+// invalidate removes the cached GET and HEAD responses of the URLs that can be answered with the written object
+// Rewrites and try_files can map other URLs to it, their missing results are outdated too
+func (handler *Handler) invalidate(r *http.Request, t *target) {
+	for _, req := range handler.readers(r, t) {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			handler.Cache.Delete(getKey(handler.Config.CacheKeyTemplate, requestWithMethod(req, method)))
+		}
+	}
+}
+
+// readers returns the requests whose lookups can find the object of the target
+// Only the request itself is returned when its path does not end with the object name, like with object templates
+func (handler *Handler) readers(r *http.Request, t *target) []*http.Request {
+	if !strings.HasSuffix(r.URL.Path, t.name) {
+		return []*http.Request{r}
+	}
+	var readers []*http.Request
+	for _, name := range readerNames(handler.Config.TryFiles, handler.Config.Rewrite, t.name) {
+		readers = append(readers, requestWithName(r, t.name, name))
+	}
+	return readers
+}
+
+// requestWithName returns a copy of the request for the object name instead of the given one
+// The cache keys use the original URL, it is changed the same way
+func requestWithName(r *http.Request, from string, to string) *http.Request {
+	rename := func(u url.URL) *url.URL {
+		if strings.HasSuffix(u.Path, from) {
+			u.Path = strings.TrimSuffix(u.Path, from) + to
+			u.RawPath = ""
+		}
+		return &u
+	}
+	copied := new(http.Request)
+	*copied = *r
+	copied.URL = rename(*r.URL)
+	if original, ok := r.Context().Value(httpserver.OriginalURLCtxKey).(url.URL); ok {
+		copied = copied.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *rename(original)))
+	}
+	return copied
+}